@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// isAddressable reports whether events of the kind are addressable
+// (parameterized replaceable), like NIP-23 long-form articles
+func isAddressable(kind int) bool {
+	return kind >= 30000 && kind < 40000
+}
+
+// eventAddress returns the "kind:pubkey:d-tag" address of an addressable event
+func eventAddress(event *nostr.Event) string {
+	return fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey, event.Tags.GetD())
+}
+
+// parseAddress checks an address from an a tag and returns its author
+func parseAddress(address string) (pubkey string, ok bool) {
+	parts := strings.SplitN(address, ":", 3)
+	if len(parts) != 3 {
+		return "", false
+	}
+	kind, err := strconv.Atoi(parts[0])
+	if err != nil || !isAddressable(kind) {
+		return "", false
+	}
+	if len(parts[1]) != PubkeyLength || !nostr.IsValid32ByteHex(parts[1]) {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// getTaggedAddress returns the first valid address in the event's tags with the given name
+func getTaggedAddress(event *nostr.Event, tagName string) string {
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == tagName {
+			if _, ok := parseAddress(tag[1]); ok {
+				return tag[1]
+			}
+		}
+	}
+	return ""
+}
+
+// getEngagedNote returns the note a reaction, zap or repost is about. Events
+// about an addressable note name it with an a tag, and usually an e tag for
+// the revision they saw. The address wins when it is stored, so engagement
+// always lands on the latest revision.
+func getEngagedNote(event *nostr.Event) (noteID, address string, err error) {
+	address = getTaggedAddress(event, "a")
+	noteID, err = getTaggedNoteID(event)
+	if err != nil && address != "" {
+		return "", address, nil
+	}
+	return noteID, address, err
+}
+
+// replaceAddressable stores a revision of an addressable note unless a newer
+// one is stored. Engagement on the replaced revision moves to the new one. It
+// returns the ID of the replaced revision, if any.
+func replaceAddressable(ctx context.Context, tx *sql.Tx, note noteRow) (string, error) {
+	// Revisions of one address arriving in concurrent batches are written in turn
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, note.Address); err != nil {
+		return "", fmt.Errorf("failed to lock address: %v", err)
+	}
+
+	var currentID string
+	var currentCreatedAt int64
+	err := tx.QueryRowContext(ctx,
+		`SELECT id, EXTRACT(EPOCH FROM created_at)::bigint FROM notes WHERE address = $1`,
+		note.Address).Scan(&currentID, &currentCreatedAt)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return "", fmt.Errorf("failed to fetch stored revision: %v", err)
+	case currentID == note.ID:
+		return "", nil
+	case currentCreatedAt > int64(note.CreatedAt),
+		currentCreatedAt == int64(note.CreatedAt) && currentID < note.ID:
+		// NIP-01 keeps the newest revision, or the lowest ID on a tie
+		return "", nil
+	}
+
+	var deleted bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM deletions
+			WHERE deleter_id = $2 AND (event_id = $1 OR (event_id = $3 AND created_at >= to_timestamp($4)))
+		)`, note.ID, note.AuthorID, note.Address, note.CreatedAt).Scan(&deleted)
+	if err != nil {
+		return "", fmt.Errorf("failed to check deletions: %v", err)
+	}
+	if deleted {
+		return "", nil
+	}
+
+	// The address is unique, so the new revision is inserted without it and
+	// takes it over once the old one is gone
+	insertQuery := `
+		INSERT INTO notes (id, author_id, kind, content, raw_json, created_at)
+		VALUES ($1, $2, $3, $4, $5::jsonb, to_timestamp($6))
+		ON CONFLICT (id) DO NOTHING;
+	`
+	if _, err := tx.ExecContext(ctx, insertQuery, note.ID, note.AuthorID, note.Kind, note.Content,
+		note.RawJSON, note.CreatedAt); err != nil {
+		return "", fmt.Errorf("failed to insert note: %v", err)
+	}
+
+	if currentID != "" {
+		// Defined in sql/0014_add_note_addresses.sql, which also uses it
+		if _, err := tx.ExecContext(ctx, `SELECT move_note_revision($1, $2)`, currentID, note.ID); err != nil {
+			return "", fmt.Errorf("failed to replace revision: %v", err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE notes SET address = $2 WHERE id = $1`, note.ID, note.Address); err != nil {
+		return "", fmt.Errorf("failed to set note address: %v", err)
+	}
+	return currentID, nil
+}
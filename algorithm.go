@@ -18,51 +18,142 @@ import (
 var (
 	weightInteractionsWithAuthor float64
 	weightCommentsGlobal         float64
+	weightDirectRepliesGlobal    float64
 	weightReactionsGlobal        float64
+	weightEmojiReactionsGlobal   float64
+	weightDislikesGlobal         float64
 	weightZapsGlobal             float64
+	weightRepostsGlobal          float64
 	weightRecency                float64
+	weightFollows                float64
+	weightFollowsOfFollows       float64
+	weightReportPenalty          float64
+	weightZapAmountGlobal        float64
+	zapAmountCurve               string
+	feedReplies                  string
 	viralThreshold               float64
 	viralNoteDampening           float64
 	decayRate                    float64
 )
 
 type CachedFeeds struct {
-	Feeds           map[int][][]FeedNote // Multiple feed variants
+	Feeds           [][]FeedNote // Multiple feed variants
 	Timestamp       time.Time
-	LastServedIndex int // Index of the last served feed variant
+	LastServedIndex int           // Index of the last served feed variant
+	Snapshot        *FeedSnapshot // Paging state for the last served variant
+}
+
+// FeedSnapshot tracks how far a client has paged through the variant it was
+// last served, so requests with until return the next page of the same
+// ranking instead of a different variant
+type FeedSnapshot struct {
+	VariantIndex int
+	Cursor       int             // Position of the next unserved note in the variant
+	Oldest       nostr.Timestamp // Oldest created_at served so far
+	Pages        []FeedPage      // Pages served from this snapshot, in order
+	Served       map[string]bool // IDs already served from this snapshot
+}
+
+// FeedPage records where a served page ended in its variant
+type FeedPage struct {
+	Oldest nostr.Timestamp // Oldest created_at served up to and including this page
+	Cursor int             // Position in the variant that follows the page
 }
 
 var userFeedCache sync.Map
 
+// feedPageMutex serializes reads and updates of the paging state in userFeedCache
+var feedPageMutex sync.Mutex
+
 const feedCacheDuration = 5 * time.Minute
 const numFeedVariants = 5   // Number of different feed variants to generate
 const variantFeedSize = 100 // Each variant feed size (fixed to 100 notes)
 
+const minAuthorInteractions = 5      // Interactions needed before an unfollowed author is a candidate
+const minFollowsOfFollowsOverlap = 2 // How many follows must follow an author to count as a follow of follows
+const maxFollowsOfFollows = 200      // Cap on follows of follows considered per user
+
 var pendingRequests = make(map[string]chan struct{})
 var pendingRequestsMutex sync.Mutex
 
-func getCacheKey(userID string, kind int) string {
-	return fmt.Sprintf("%s_kind_%d", userID, kind)
+// getCacheKey builds the cache key for a user's feed profile ("" for their
+// main feed) and a normalized kind set
+func getCacheKey(userID, profile string, kinds []int) string {
+	kindStrings := make([]string, len(kinds))
+	for i, kind := range kinds {
+		kindStrings[i] = strconv.Itoa(kind)
+	}
+	if profile != "" {
+		return fmt.Sprintf("%s_feed_%s_kinds_%s", userID, profile, strings.Join(kindStrings, ","))
+	}
+	return fmt.Sprintf("%s_kinds_%s", userID, strings.Join(kindStrings, ","))
+}
+
+// normalizeKinds sorts and de-duplicates the requested kinds so that the same
+// kind set always maps to the same cache entry. An empty set means text notes.
+func normalizeKinds(kinds []int) []int {
+	if len(kinds) == 0 {
+		return []int{nostr.KindTextNote}
+	}
+
+	seen := make(map[int]bool, len(kinds))
+	normalized := make([]int, 0, len(kinds))
+	for _, kind := range kinds {
+		if !seen[kind] {
+			seen[kind] = true
+			normalized = append(normalized, kind)
+		}
+	}
+	sort.Ints(normalized)
+	return normalized
 }
 
-func GetUserFeed(ctx context.Context, userID string, limit, kind int) ([]nostr.Event, error) {
+// GetUserFeed serves a page of the user's feed, or of one of their named feed
+// profiles. Requests without until start a new snapshot from the next feed
+// variant ("pull to refresh"); requests with until continue paging through the
+// current snapshot without duplicates.
+func GetUserFeed(ctx context.Context, userID, profile string, limit int, kinds []int, since, until *nostr.Timestamp) ([]nostr.Event, error) {
 	now := time.Now()
 
+	// Named feeds have their own settings, and their own kinds when the
+	// client doesn't ask for any
+	var feedProfile FeedProfile
+	if profile != "" {
+		var err error
+		feedProfile, err = repository.GetFeedProfile(userID, profile)
+		if err != nil {
+			return nil, err
+		}
+		if len(kinds) == 0 {
+			kinds = feedProfile.Kinds
+		}
+	}
+	kinds = normalizeKinds(kinds)
+
+	// Paging requests keep using the snapshot the client is scrolling through,
+	// even past feedCacheDuration, so pages stay consistent
+	if until != nil {
+		if cached, ok := getCachedUserFeeds(userID, profile, kinds); ok && cached.Snapshot != nil {
+			log.Println("Serving next feed page for user:", userID, "kinds:", kinds)
+			return serveFeedPage(userID, profile, kinds, limit, until), nil
+		}
+	}
+
 	// Check cache first
-	if cached, ok := getCachedUserFeeds(userID, kind); ok && now.Sub(cached.Timestamp) < feedCacheDuration {
-		log.Println("Returning cached feed for user:", userID, "kind:", kind)
-		return serveSequentialFeedResult(userID, kind, cached, limit), nil
+	if cached, ok := getCachedUserFeeds(userID, profile, kinds); ok && now.Sub(cached.Timestamp) < feedCacheDuration {
+		log.Println("Returning cached feed for user:", userID, "kinds:", kinds)
+		return serveSequentialFeedResult(userID, profile, kinds, limit, since), nil
 	}
 
-	// Ensure no duplicate feed generation for the same user/kind
+	// Ensure no duplicate feed generation for the same user/kind set
 	pendingRequestsMutex.Lock()
-	cacheKey := getCacheKey(userID, kind)
+	cacheKey := getCacheKey(userID, profile, kinds)
 	if pending, exists := pendingRequests[cacheKey]; exists {
-		log.Println("Waiting for existing feed generation for user:", userID, "kind:", kind)
+		log.Println("Waiting for existing feed generation for user:", userID, "kinds:", kinds)
 		pendingRequestsMutex.Unlock()
 		<-pending
-		if cached, ok := getCachedUserFeeds(userID, kind); ok && now.Sub(cached.Timestamp) < feedCacheDuration {
-			return serveSequentialFeedResult(userID, kind, cached, limit), nil
+		if cached, ok := getCachedUserFeeds(userID, profile, kinds); ok && now.Sub(cached.Timestamp) < feedCacheDuration {
+			return serveSequentialFeedResult(userID, profile, kinds, limit, since), nil
 		}
 		return nil, fmt.Errorf("feed generation failed after waiting for cache")
 	}
@@ -79,101 +170,213 @@ func GetUserFeed(ctx context.Context, userID string, limit, kind int) ([]nostr.E
 		pendingRequestsMutex.Unlock()
 	}()
 
+	// A new user's history is imported in the background, the feed is
+	// regenerated once it lands
+	enqueueOnboarding(userID)
+
 	// Generate the feed
-	log.Println("No cache or pending request found, generating feed variants for user:", userID, "kind:", kind)
-	authorFeed, err := repository.GetUserFeedByAuthors(ctx, userID, variantFeedSize*numFeedVariants, kind)
+	log.Println("No cache or pending request found, generating feed variants for user:", userID, "kinds:", kinds)
+	settings := feedProfile.Settings
+	if profile == "" {
+		var err error
+		settings, err = repository.GetUserSettings(userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	feedVariants, err := buildFeedVariants(ctx, userID, kinds, settings)
 	if err != nil {
 		return nil, err
 	}
 
-	// Fetch viral notes
+	// Store the new variants, keeping the rotation and the previous snapshot so
+	// a refresh after regeneration still skips what the client has seen
+	storeCachedUserFeeds(userID, profile, kinds, feedVariants)
+
+	// Serve the sequential feed result
+	return serveSequentialFeedResult(userID, profile, kinds, limit, since), nil
+}
+
+// buildFeedVariants ranks the user's network and the viral pool with the given
+// settings and blends them into feed variants. It doesn't touch the feed cache.
+func buildFeedVariants(ctx context.Context, userID string, kinds []int, settings UserSettings) ([][]FeedNote, error) {
+	authorFeed, err := repository.GetUserFeedByAuthors(ctx, userID, variantFeedSize*numFeedVariants, kinds, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	// Score the shared viral notes with the user's own settings
 	viralNoteCacheMutex.Lock()
-	viralFeed := viralNoteCache.notes
+	viralPool := viralNoteCache.notes
 	viralNoteCacheMutex.Unlock()
 
-	// Generate feed variants
-	feedVariants := generateFeedVariants(authorFeed, viralFeed, variantFeedSize, kind)
+	viralFeed := scoreViralNotes(viralPool, settings)
 
-	// Retrieve existing cached feeds or create a new one
-	cachedFeeds, _ := getCachedUserFeeds(userID, kind)
-	if cachedFeeds.Feeds == nil {
-		cachedFeeds.Feeds = make(map[int][][]FeedNote)
+	// Penalize notes reported by people the user follows
+	authorFeed, err = repository.applyReportPenalty(userID, authorFeed, settings.ReportPenalty)
+	if err != nil {
+		return nil, err
+	}
+	viralFeed, err = repository.applyReportPenalty(userID, viralFeed, settings.ReportPenalty)
+	if err != nil {
+		return nil, err
 	}
 
-	// Update cached feeds for this kind
-	cachedFeeds.Feeds[kind] = feedVariants
-	cachedFeeds.Timestamp = now
-	cachedFeeds.LastServedIndex = -1
-
-	// Store the updated cached feeds
-	storeCachedUserFeeds(userID, kind, feedVariants, &cachedFeeds)
+	mutes, err := repository.GetMuteList(userID)
+	if err != nil {
+		return nil, err
+	}
 
-	// Serve the sequential feed result
-	return serveSequentialFeedResult(userID, kind, cachedFeeds, limit), nil
+	return generateFeedVariants(authorFeed, viralFeed, variantFeedSize, kinds, settings.KindQuotas, mutes), nil
 }
 
-func getCachedUserFeeds(userID string, kind int) (CachedFeeds, bool) {
-	cacheKey := getCacheKey(userID, kind)
+func getCachedUserFeeds(userID, profile string, kinds []int) (CachedFeeds, bool) {
+	cacheKey := getCacheKey(userID, profile, kinds)
 	if cached, ok := userFeedCache.Load(cacheKey); ok {
 		return cached.(CachedFeeds), true
 	}
 	return CachedFeeds{}, false
 }
 
-func storeCachedUserFeeds(userID string, kind int, feedVariants [][]FeedNote, cachedFeeds *CachedFeeds) {
-	if cachedFeeds.Feeds == nil {
-		cachedFeeds.Feeds = make(map[int][][]FeedNote)
+func storeCachedUserFeeds(userID, profile string, kinds []int, feedVariants [][]FeedNote) {
+	feedPageMutex.Lock()
+	defer feedPageMutex.Unlock()
+
+	cachedFeeds, ok := getCachedUserFeeds(userID, profile, kinds)
+	if !ok {
+		cachedFeeds.LastServedIndex = -1
 	}
-	cachedFeeds.Feeds[kind] = feedVariants
+	cachedFeeds.Feeds = feedVariants
 	cachedFeeds.Timestamp = time.Now()
 
-	cacheKey := getCacheKey(userID, kind)
-	log.Printf("Caching feed variants for key: %s (kind %d) for user: %s", cacheKey, kind, userID)
-	userFeedCache.Store(cacheKey, *cachedFeeds)
+	cacheKey := getCacheKey(userID, profile, kinds)
+	log.Printf("Caching feed variants for key: %s (kinds %v) for user: %s", cacheKey, kinds, userID)
+	userFeedCache.Store(cacheKey, cachedFeeds)
 }
 
-func serveSequentialFeedResult(userID string, kind int, cachedFeeds CachedFeeds, limit int) []nostr.Event {
-	cacheKey := getCacheKey(userID, kind)
+// serveSequentialFeedResult rotates to the next feed variant and serves its
+// first page. When since is set the client already has a feed, so notes it
+// was served from the previous snapshot are skipped.
+func serveSequentialFeedResult(userID, profile string, kinds []int, limit int, since *nostr.Timestamp) []nostr.Event {
+	feedPageMutex.Lock()
+	defer feedPageMutex.Unlock()
+
+	cacheKey := getCacheKey(userID, profile, kinds)
+	cachedFeeds, _ := getCachedUserFeeds(userID, profile, kinds)
 
-	feedVariants, ok := cachedFeeds.Feeds[kind]
-	if !ok || len(feedVariants) == 0 {
-		log.Printf("No feed variants available for user: %s, kind: %d", userID, kind)
+	feedVariants := cachedFeeds.Feeds
+	if len(feedVariants) == 0 {
+		log.Printf("No feed variants available for user: %s, kinds: %v", userID, kinds)
 		return nil
 	}
 
 	nextIndex := (cachedFeeds.LastServedIndex + 1) % len(feedVariants)
-	selectedFeed := feedVariants[nextIndex]
+	snapshot := &FeedSnapshot{
+		VariantIndex: nextIndex,
+		Served:       make(map[string]bool),
+	}
+
+	var exclude map[string]bool
+	if since != nil && cachedFeeds.Snapshot != nil {
+		exclude = cachedFeeds.Snapshot.Served
+	}
+
+	result := snapshot.nextPage(feedVariants[nextIndex], 0, limit, exclude, nil)
 	cachedFeeds.LastServedIndex = nextIndex
+	cachedFeeds.Snapshot = snapshot
 	userFeedCache.Store(cacheKey, cachedFeeds)
 
-	var result []nostr.Event
-	for i, feedNote := range selectedFeed {
-		if i >= limit {
+	log.Printf("Serving feed variant %d with %d notes (limit %d, kinds %v) for user: %s", nextIndex, len(result), limit, kinds, userID)
+	return result
+}
+
+// serveFeedPage serves the page following until from the current snapshot.
+// Clients usually send the oldest created_at they have received as until, so
+// that timestamp is mapped back to the page it ended; otherwise paging
+// continues from the last served position. Only notes created at or before
+// until are served, as the filter asks.
+func serveFeedPage(userID, profile string, kinds []int, limit int, until *nostr.Timestamp) []nostr.Event {
+	feedPageMutex.Lock()
+	defer feedPageMutex.Unlock()
+
+	cacheKey := getCacheKey(userID, profile, kinds)
+	cachedFeeds, _ := getCachedUserFeeds(userID, profile, kinds)
+	snapshot := cachedFeeds.Snapshot
+
+	feedVariants := cachedFeeds.Feeds
+	if snapshot == nil || snapshot.VariantIndex >= len(feedVariants) {
+		return nil
+	}
+
+	// Some clients send one second less than the oldest created_at. When
+	// several pages end at the same timestamp, paging continues after the last.
+	start := snapshot.Cursor
+	for i := len(snapshot.Pages) - 1; i >= 0; i-- {
+		page := snapshot.Pages[i]
+		if page.Oldest == *until || page.Oldest == *until+1 {
+			start = page.Cursor
 			break
 		}
-		result = append(result, feedNote.Event)
 	}
 
-	log.Printf("Serving feed variant %d with %d notes (limit %d, kind %d) for user: %s", nextIndex, len(result), limit, kind, userID)
+	result := snapshot.nextPage(feedVariants[snapshot.VariantIndex], start, limit, nil, until)
+	userFeedCache.Store(cacheKey, cachedFeeds)
+
+	log.Printf("Serving page from position %d of feed variant %d with %d notes (limit %d, kinds %v) for user: %s", start, snapshot.VariantIndex, len(result), limit, kinds, userID)
 	return result
 }
 
-func generateFeedVariants(authorFeed, viralFeed []FeedNote, variantSize int, kind int) [][]FeedNote {
+// nextPage returns up to limit notes of the variant starting at start and
+// records the page in the snapshot. Notes created after until are skipped;
+// they are served again from the next snapshot.
+func (s *FeedSnapshot) nextPage(variant []FeedNote, start, limit int, exclude map[string]bool, until *nostr.Timestamp) []nostr.Event {
+	var result []nostr.Event
+	position := start
+	for ; position < len(variant) && len(result) < limit; position++ {
+		event := variant[position].Event
+		if exclude[event.ID] || (until != nil && event.CreatedAt > *until) {
+			continue
+		}
+		result = append(result, event)
+		s.Served[event.ID] = true
+		if s.Oldest == 0 || event.CreatedAt < s.Oldest {
+			s.Oldest = event.CreatedAt
+		}
+	}
+
+	s.Cursor = position
+	if len(result) > 0 {
+		s.Pages = append(s.Pages, FeedPage{Oldest: s.Oldest, Cursor: position})
+	}
+	return result
+}
+
+func generateFeedVariants(authorFeed, viralFeed []FeedNote, variantSize int, kinds []int, kindQuotas map[int]float64, mutes MuteList) [][]FeedNote {
 	var filteredAuthorFeed []FeedNote
 	var filteredViralFeed []FeedNote
 
+	requestedKinds := make(map[int]bool, len(kinds))
+	for _, kind := range kinds {
+		requestedKinds[kind] = true
+	}
+
+	// Keep only the requested kinds and drop anything the user muted
 	for _, note := range authorFeed {
-		if note.Event.Kind == kind {
+		if requestedKinds[note.Event.Kind] && !mutes.Matches(note.Event) {
 			filteredAuthorFeed = append(filteredAuthorFeed, note)
 		}
 	}
 
 	for _, note := range viralFeed {
-		if note.Event.Kind == kind {
+		if requestedKinds[note.Event.Kind] && !mutes.Matches(note.Event) {
 			filteredViralFeed = append(filteredViralFeed, note)
 		}
 	}
 
+	// Collect more candidates than fit in a variant when several kinds are
+	// requested, so the kind quotas have something to choose from
+	candidateSize := variantSize * len(kinds)
+
 	// Group notes by author
 	authorNotes := make(map[string][]FeedNote)
 	for _, note := range filteredAuthorFeed {
@@ -190,7 +393,7 @@ func generateFeedVariants(authorFeed, viralFeed []FeedNote, variantSize int, kin
 	// Distribute one note per author across all variants
 	for _, notes := range authorNotes {
 		for i := 0; i < len(notes) && i < numFeedVariants; i++ {
-			if len(feedVariants[i]) < variantSize {
+			if len(feedVariants[i]) < candidateSize {
 				feedVariants[i] = append(feedVariants[i], notes[i])
 			}
 		}
@@ -200,7 +403,7 @@ func generateFeedVariants(authorFeed, viralFeed []FeedNote, variantSize int, kin
 	usedAuthors := make(map[string]bool)
 	for i := 0; i < numFeedVariants; i++ {
 		for _, viralNote := range filteredViralFeed {
-			if len(feedVariants[i]) >= variantSize {
+			if len(feedVariants[i]) >= candidateSize {
 				break
 			}
 			authorID := viralNote.Event.PubKey
@@ -211,21 +414,69 @@ func generateFeedVariants(authorFeed, viralFeed []FeedNote, variantSize int, kin
 		}
 	}
 
-	// Sort each feed by score in descending order and truncate to variant size
+	// Sort each feed by score in descending order and cut it down to the
+	// variant size while respecting the kind quotas
 	for i := range feedVariants {
 		sort.Slice(feedVariants[i], func(a, b int) bool {
 			return feedVariants[i][a].Score > feedVariants[i][b].Score
 		})
-		if len(feedVariants[i]) > variantSize {
-			feedVariants[i] = feedVariants[i][:variantSize]
-		}
+		feedVariants[i] = applyKindQuotas(feedVariants[i], kinds, kindQuotas, variantSize)
 	}
 
-	log.Printf("Generated %d feed variants for kind %d, each with up to %d notes", numFeedVariants, kind, variantSize)
+	log.Printf("Generated %d feed variants for kinds %v, each with up to %d notes", numFeedVariants, kinds, variantSize)
 	return feedVariants
 }
 
-func (r *NostrRepository) GetUserFeedByAuthors(ctx context.Context, userID string, limit, kind int) ([]FeedNote, error) {
+// applyKindQuotas picks up to size notes from a score-sorted list so that each
+// kind takes at most its share of the feed. Kinds without a quota share the
+// feed evenly. Slots a kind can't fill go to the best remaining notes of any
+// kind, so quotas never leave a feed shorter than it could be.
+func applyKindQuotas(notes []FeedNote, kinds []int, kindQuotas map[int]float64, size int) []FeedNote {
+	if len(kinds) < 2 {
+		if len(notes) > size {
+			return notes[:size]
+		}
+		return notes
+	}
+
+	caps := make(map[int]int, len(kinds))
+	for _, kind := range kinds {
+		share := kindQuotas[kind]
+		if share <= 0 {
+			share = 1 / float64(len(kinds))
+		}
+		caps[kind] = int(math.Ceil(share * float64(size)))
+	}
+
+	selected := make([]FeedNote, 0, size)
+	var overflow []FeedNote
+	counts := make(map[int]int, len(kinds))
+	for _, note := range notes {
+		if len(selected) >= size {
+			break
+		}
+		if counts[note.Event.Kind] < caps[note.Event.Kind] {
+			selected = append(selected, note)
+			counts[note.Event.Kind]++
+		} else {
+			overflow = append(overflow, note)
+		}
+	}
+
+	for _, note := range overflow {
+		if len(selected) >= size {
+			break
+		}
+		selected = append(selected, note)
+	}
+
+	sort.Slice(selected, func(a, b int) bool {
+		return selected[a].Score > selected[b].Score
+	})
+	return selected
+}
+
+func (r *NostrRepository) GetUserFeedByAuthors(ctx context.Context, userID string, limit int, kinds []int, settings UserSettings) ([]FeedNote, error) {
 	authorInteractions, err := r.fetchTopInteractedAuthors(userID)
 	if err != nil {
 		return nil, err
@@ -233,17 +484,45 @@ func (r *NostrRepository) GetUserFeedByAuthors(ctx context.Context, userID strin
 
 	fmt.Println("Fetched top interacted authors:", len(authorInteractions))
 
-	notes, err := r.fetchNotesFromAuthors(authorInteractions, kind)
+	start := time.Now()
+	follows, err := r.fetchFollows(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var followsOfFollows []AuthorInteraction
+	if settings.FollowsOfFollows > 0 {
+		followsOfFollows, err = r.fetchFollowsOfFollows(userID, minFollowsOfFollowsOverlap, maxFollowsOfFollows)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("Fetched %d follows and %d follows of follows in %v", len(follows), len(followsOfFollows), time.Since(start))
+
+	candidates := buildAuthorCandidates(authorInteractions, follows, followsOfFollows)
+
+	// Settings saved without a replies choice use the relay's default
+	replies := settings.Replies
+	if replies == "" {
+		replies = feedReplies
+	}
+	// Replies to the user count as replies between people they follow
+	notes, err := r.fetchNotesFromAuthors(candidates, kinds, replies, append(follows, userID))
 	if err != nil {
 		return nil, err
 	}
 
 	fmt.Println("Fetched notes from authors:", len(notes))
+	authorsByID := make(map[string]AuthorInteraction, len(candidates))
+	for _, candidate := range candidates {
+		authorsByID[candidate.AuthorID] = candidate
+	}
+
 	var FeedNotes []FeedNote
 	for _, note := range notes {
-		interactionCount := getInteractionCountForAuthor(note.Event.PubKey, authorInteractions)
-		score := r.calculateAuthorNoteScore(note, interactionCount, userID)
-		FeedNotes = append(FeedNotes, FeedNote{Event: note.Event, Score: score})
+		breakdown := calculateAuthorNoteScore(note, authorsByID[note.Event.PubKey], settings)
+		FeedNotes = append(FeedNotes, FeedNote{Event: note.Event, Score: breakdown.Total, Breakdown: breakdown})
 	}
 
 	// Sort all posts by score in descending order initially
@@ -254,62 +533,198 @@ func (r *NostrRepository) GetUserFeedByAuthors(ctx context.Context, userID strin
 	return FeedNotes, nil
 }
 
-func getInteractionCountForAuthor(authorID string, interactions []AuthorInteraction) int {
+// buildAuthorCandidates merges the authors a user interacts with and the
+// follow graph into a single candidate list. Interacted authors need at least
+// minAuthorInteractions to qualify, while followed authors always qualify so
+// that a fresh account still gets a feed.
+func buildAuthorCandidates(interactions []AuthorInteraction, follows []string, followsOfFollows []AuthorInteraction) []AuthorInteraction {
+	candidates := make(map[string]*AuthorInteraction)
+	order := make([]string, 0, len(interactions)+len(follows)+len(followsOfFollows))
+
+	add := func(authorID string) *AuthorInteraction {
+		if candidate, ok := candidates[authorID]; ok {
+			return candidate
+		}
+		candidate := &AuthorInteraction{AuthorID: authorID}
+		candidates[authorID] = candidate
+		order = append(order, authorID)
+		return candidate
+	}
+
+	interactionsByID := make(map[string]AuthorInteraction, len(interactions))
 	for _, interaction := range interactions {
-		if interaction.AuthorID == authorID {
-			return interaction.InteractionCount
+		interactionsByID[interaction.AuthorID] = interaction
+		if interaction.InteractionCount >= minAuthorInteractions {
+			candidate := add(interaction.AuthorID)
+			candidate.InteractionCount = interaction.InteractionCount
+			candidate.ZapSats = interaction.ZapSats
 		}
 	}
-	return 0
-}
 
-func (r *NostrRepository) calculateAuthorNoteScore(event EventWithMeta, interactionCount int, userID string) float64 {
-	// Get user settings
-	userSettings, err := r.GetUserSettings(userID)
+	for _, followID := range follows {
+		candidate := add(followID)
+		candidate.Followed = true
+		candidate.InteractionCount = interactionsByID[followID].InteractionCount
+		candidate.ZapSats = interactionsByID[followID].ZapSats
+	}
 
-	// Use user-specific weights if available, otherwise fall back to global weights
-	authorInteractionsWeight := weightInteractionsWithAuthor
-	commentsWeight := weightCommentsGlobal
-	reactionsWeight := weightReactionsGlobal
-	zapsWeight := weightZapsGlobal
-	recencyWeight := weightRecency
-	decayRateValue := decayRate
+	for _, fof := range followsOfFollows {
+		add(fof.AuthorID).FollowedByFollows = fof.FollowedByFollows
+	}
 
-	if err == nil {
-		// User has custom settings, use them
-		authorInteractionsWeight = userSettings.AuthorInteractions
-		commentsWeight = userSettings.GlobalComments
-		reactionsWeight = userSettings.GlobalReactions
-		zapsWeight = userSettings.GlobalZaps
-		recencyWeight = userSettings.Recency
-		decayRateValue = userSettings.DecayRate
+	result := make([]AuthorInteraction, 0, len(order))
+	for _, authorID := range order {
+		result = append(result, *candidates[authorID])
 	}
+	return result
+}
+
+func calculateAuthorNoteScore(event EventWithMeta, author AuthorInteraction, settings UserSettings) ScoreBreakdown {
+	breakdown := globalEngagementScore(event, settings)
+	breakdown.Source = "author"
 
 	// Calculate recency factor with potentially user-specific decay rate
-	recencyFactor := calculateRecencyFactorWithDecay(event.CreatedAt, decayRateValue)
+	recencyFactor := calculateRecencyFactorWithDecay(event.CreatedAt, settings.DecayRate)
+	breakdown.Recency = recencyFactor * settings.Recency
+
+	// Sats the user zapped to the author count towards their affinity on top
+	// of the raw number of interactions
+	affinity := float64(author.InteractionCount) + zapAmountScore(author.ZapSats, settings.ZapCurve)
+	breakdown.AuthorAffinity = affinity * settings.AuthorInteractions
+
+	// Followed authors get a flat boost, authors followed by several of the
+	// user's follows get a smaller boost that grows with the overlap.
+	if author.Followed {
+		breakdown.Follows = settings.Follows
+	} else if author.FollowedByFollows > 0 {
+		breakdown.FollowsOfFollows = math.Log1p(float64(author.FollowedByFollows)) * settings.FollowsOfFollows
+	}
 
-	// Calculate score using user-specific weights
-	score := float64(event.GlobalCommentsCount)*commentsWeight +
-		float64(event.GlobalReactionsCount)*reactionsWeight +
-		float64(event.GlobalZapsCount)*zapsWeight +
-		recencyFactor*recencyWeight +
-		float64(interactionCount)*authorInteractionsWeight
+	breakdown.Total = breakdown.sum()
+	return breakdown
+}
 
-	return score
+// scoreViralNotes applies the user's viral threshold, weights and dampening to
+// the shared viral pool
+func scoreViralNotes(pool []EventWithMeta, settings UserSettings) []FeedNote {
+	viralNotes := make([]FeedNote, 0, len(pool))
+	for _, note := range pool {
+		// Dislikes cancel out positive reactions when deciding what is viral
+		engagement := note.GlobalCommentsCount + note.GlobalReactionsCount + note.GlobalEmojiCount -
+			note.GlobalDislikesCount + note.GlobalZapsCount + note.GlobalRepostsCount + note.GlobalQuotesCount
+		if float64(engagement) < settings.ViralThreshold {
+			continue
+		}
+
+		breakdown := globalEngagementScore(note, settings)
+		breakdown.Source = "viral"
+		recencyFactor := calculateRecencyFactorWithDecay(note.CreatedAt, settings.DecayRate)
+		breakdown.Recency = recencyFactor * settings.Recency
+
+		// Dampening scales the whole score down, recorded as what it took off
+		breakdown.ViralDampening = breakdown.sum() * (settings.ViralDampening - 1)
+		breakdown.Total = breakdown.sum()
+
+		viralNotes = append(viralNotes, FeedNote{Event: note.Event, Score: breakdown.Total, Breakdown: breakdown})
+	}
+
+	sort.Slice(viralNotes, func(i, j int) bool {
+		return viralNotes[i].Score > viralNotes[j].Score
+	})
+
+	return viralNotes
+}
+
+// globalEngagementScore weights the note's network-wide comments, reactions,
+// zaps, reposts and quotes. Commenters replying to the note itself count again on top of
+// everyone in the thread. Dislikes lower the score.
+func globalEngagementScore(note EventWithMeta, settings UserSettings) ScoreBreakdown {
+	return ScoreBreakdown{
+		Comments:       float64(note.GlobalCommentsCount) * settings.GlobalComments,
+		DirectReplies:  float64(note.GlobalDirectReplies) * settings.GlobalDirectReplies,
+		Reactions:      float64(note.GlobalReactionsCount) * settings.GlobalReactions,
+		EmojiReactions: float64(note.GlobalEmojiCount) * settings.GlobalEmojiReactions,
+		Dislikes:       -float64(note.GlobalDislikesCount) * settings.GlobalDislikes,
+		Zaps:           float64(note.GlobalZapsCount) * settings.GlobalZaps,
+		ZapAmount:      zapAmountScore(note.GlobalZapSats, settings.ZapCurve) * settings.GlobalZapAmount,
+		Reposts:        float64(note.GlobalRepostsCount+note.GlobalQuotesCount) * settings.GlobalReposts,
+	}
+}
+
+// zapAmountScore turns an amount of zapped sats into a score, counted in
+// thousands of sats. The log and sqrt curves flatten large amounts so a single
+// whale can't dominate the ranking.
+func zapAmountScore(sats int64, curve string) float64 {
+	if sats <= 0 {
+		return 0
+	}
+
+	kiloSats := float64(sats) / 1000
+	switch curve {
+	case "linear":
+		return kiloSats
+	case "sqrt":
+		return math.Sqrt(kiloSats)
+	default:
+		return math.Log1p(kiloSats)
+	}
 }
 
 // invalidateUserFeedCache removes all cached feeds for a user
 func invalidateUserFeedCache(userID string) {
 	log.Printf("Invalidating feed cache for user: %s", userID)
 
-	// We need to remove all kinds of feeds for this user
-	// Common kinds are 1 (text notes), 30023 (articles), 20 (images)
-	commonKinds := []int{1, 30023, 20}
+	// Feeds are cached per kind set, so remove every entry for this user
+	prefix := userID + "_"
+	userFeedCache.Range(func(key, value any) bool {
+		if strings.HasPrefix(key.(string), prefix) {
+			userFeedCache.Delete(key)
+		}
+		return true
+	})
+}
+
+// invalidateFeedProfileCache removes the cached feeds of one named feed profile
+func invalidateFeedProfileCache(userID, profile string) {
+	log.Printf("Invalidating feed cache for user: %s, feed: %s", userID, profile)
+
+	prefix := userID + "_feed_" + profile + "_kinds_"
+	userFeedCache.Range(func(key, value any) bool {
+		if strings.HasPrefix(key.(string), prefix) {
+			userFeedCache.Delete(key)
+		}
+		return true
+	})
+}
+
+// invalidateFeedsContaining removes every cached feed that includes one of the
+// events, and drops the events from the viral pool
+func invalidateFeedsContaining(eventIDs []string) {
+	ids := toSet(eventIDs)
+
+	userFeedCache.Range(func(key, value any) bool {
+		cachedFeeds := value.(CachedFeeds)
+		for _, variant := range cachedFeeds.Feeds {
+			for _, note := range variant {
+				if ids[note.Event.ID] {
+					log.Printf("Invalidating cached feed %s containing deleted event %s", key, note.Event.ID)
+					userFeedCache.Delete(key)
+					return true
+				}
+			}
+		}
+		return true
+	})
 
-	for _, kind := range commonKinds {
-		cacheKey := getCacheKey(userID, kind)
-		userFeedCache.Delete(cacheKey)
+	viralNoteCacheMutex.Lock()
+	viralPool := make([]EventWithMeta, 0, len(viralNoteCache.notes))
+	for _, note := range viralNoteCache.notes {
+		if !ids[note.Event.ID] {
+			viralPool = append(viralPool, note)
+		}
 	}
+	viralNoteCache.notes = viralPool
+	viralNoteCacheMutex.Unlock()
 }
 
 // New function to calculate recency with custom decay rate
@@ -346,3 +761,39 @@ func getWeightFloat64(envKey string) float64 {
 
 	return w
 }
+
+// getZapCurve reads the zap amount curve from the environment, defaulting to log
+func getZapCurve(envKey string) string {
+	curve := strings.ToLower(strings.TrimSpace(os.Getenv(envKey)))
+	if !isValidZapCurve(curve) || curve == "" {
+		log.Printf("Environment variable %s not set or invalid, defaulting to log", envKey)
+		return "log"
+	}
+	return curve
+}
+
+// getRepliesSetting reads which replies are feed candidates by default, defaulting to follows
+func getRepliesSetting(envKey string) string {
+	replies := strings.ToLower(strings.TrimSpace(os.Getenv(envKey)))
+	if !isValidRepliesSetting(replies) || replies == "" {
+		log.Printf("Environment variable %s not set or invalid, defaulting to follows", envKey)
+		return "follows"
+	}
+	return replies
+}
+
+func isValidRepliesSetting(replies string) bool {
+	switch replies {
+	case "", "off", "follows", "all":
+		return true
+	}
+	return false
+}
+
+func isValidZapCurve(curve string) bool {
+	switch curve {
+	case "", "log", "sqrt", "linear":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// rankedNotes returns notes n0, n1, ... in ranking order, created at the given times
+func rankedNotes(createdAt ...nostr.Timestamp) []FeedNote {
+	notes := make([]FeedNote, len(createdAt))
+	for i, ts := range createdAt {
+		notes[i] = FeedNote{
+			Event: nostr.Event{ID: fmt.Sprintf("n%d", i), Kind: 1, CreatedAt: ts},
+			Score: float64(len(createdAt) - i),
+		}
+	}
+	return notes
+}
+
+func eventIDs(events []nostr.Event) []string {
+	var ids []string
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+func timestamp(ts nostr.Timestamp) *nostr.Timestamp {
+	return &ts
+}
+
+func TestFeedSnapshotNextPage(t *testing.T) {
+	variant := rankedNotes(100, 90, 80, 70, 60)
+
+	tests := []struct {
+		name       string
+		start      int
+		limit      int
+		exclude    map[string]bool
+		until      *nostr.Timestamp
+		want       []string
+		wantCursor int
+		wantPages  []FeedPage
+	}{
+		{
+			name:       "first page",
+			limit:      2,
+			want:       []string{"n0", "n1"},
+			wantCursor: 2,
+			wantPages:  []FeedPage{{Oldest: 90, Cursor: 2}},
+		},
+		{
+			name:       "skips notes already served",
+			limit:      2,
+			exclude:    map[string]bool{"n1": true},
+			want:       []string{"n0", "n2"},
+			wantCursor: 3,
+			wantPages:  []FeedPage{{Oldest: 80, Cursor: 3}},
+		},
+		{
+			name:       "skips notes created after until",
+			limit:      2,
+			until:      timestamp(85),
+			want:       []string{"n2", "n3"},
+			wantCursor: 4,
+			wantPages:  []FeedPage{{Oldest: 70, Cursor: 4}},
+		},
+		{
+			name:       "stops at the end of the variant",
+			start:      4,
+			limit:      3,
+			want:       []string{"n4"},
+			wantCursor: 5,
+			wantPages:  []FeedPage{{Oldest: 60, Cursor: 5}},
+		},
+		{
+			name:       "empty page isn't recorded",
+			start:      5,
+			limit:      3,
+			wantCursor: 5,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			snapshot := &FeedSnapshot{Served: make(map[string]bool)}
+			got := eventIDs(snapshot.nextPage(variant, test.start, test.limit, test.exclude, test.until))
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("served %v, want %v", got, test.want)
+			}
+			if snapshot.Cursor != test.wantCursor {
+				t.Errorf("cursor = %d, want %d", snapshot.Cursor, test.wantCursor)
+			}
+			if !reflect.DeepEqual(snapshot.Pages, test.wantPages) {
+				t.Errorf("pages = %v, want %v", snapshot.Pages, test.wantPages)
+			}
+			for _, id := range test.want {
+				if !snapshot.Served[id] {
+					t.Errorf("%s isn't marked as served", id)
+				}
+			}
+		})
+	}
+}
+
+func TestServeFeedPage(t *testing.T) {
+	kinds := []int{1}
+	variant := rankedNotes(100, 90, 90, 80, 70, 60)
+
+	tests := []struct {
+		name   string
+		before []nostr.Timestamp // until of the pages requested after the first one
+		until  nostr.Timestamp
+		want   []string
+	}{
+		{
+			name:  "until is the oldest note of the first page",
+			until: 90,
+			want:  []string{"n2", "n3"},
+		},
+		{
+			name:  "until is one second before the oldest note",
+			until: 89,
+			want:  []string{"n3", "n4"},
+		},
+		{
+			name:   "repeated until serves the same page again",
+			before: []nostr.Timestamp{90},
+			until:  90,
+			want:   []string{"n2", "n3"},
+		},
+		{
+			name:   "until of the second page",
+			before: []nostr.Timestamp{90},
+			until:  80,
+			want:   []string{"n4", "n5"},
+		},
+		{
+			name:  "unknown until continues from the last page",
+			until: 75,
+			want:  []string{"n4", "n5"},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			userID := fmt.Sprintf("paging-user-%d", i)
+			defer userFeedCache.Delete(getCacheKey(userID, "", kinds))
+
+			storeCachedUserFeeds(userID, "", kinds, [][]FeedNote{variant})
+			first := eventIDs(serveSequentialFeedResult(userID, "", kinds, 2, nil))
+			if want := []string{"n0", "n1"}; !reflect.DeepEqual(first, want) {
+				t.Fatalf("first page = %v, want %v", first, want)
+			}
+			for _, until := range test.before {
+				serveFeedPage(userID, "", kinds, 2, &until)
+			}
+
+			got := eventIDs(serveFeedPage(userID, "", kinds, 2, &test.until))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("served %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// kindNotes returns notes n0, n1, ... of the given kinds, ranked in that order
+func kindNotes(kinds ...int) []FeedNote {
+	notes := make([]FeedNote, len(kinds))
+	for i, kind := range kinds {
+		notes[i] = FeedNote{
+			Event: nostr.Event{ID: fmt.Sprintf("n%d", i), Kind: kind},
+			Score: float64(len(kinds) - i),
+		}
+	}
+	return notes
+}
+
+func TestApplyKindQuotas(t *testing.T) {
+	tests := []struct {
+		name   string
+		notes  []FeedNote
+		kinds  []int
+		quotas map[int]float64
+		size   int
+		want   []string
+	}{
+		{
+			name:  "one kind is cut to size",
+			notes: kindNotes(1, 1, 1, 1),
+			kinds: []int{1},
+			size:  3,
+			want:  []string{"n0", "n1", "n2"},
+		},
+		{
+			name:  "one kind shorter than size",
+			notes: kindNotes(1, 1),
+			kinds: []int{1},
+			size:  3,
+			want:  []string{"n0", "n1"},
+		},
+		{
+			name:  "kinds without quotas share evenly",
+			notes: kindNotes(1, 1, 1, 1, 30023, 30023),
+			kinds: []int{1, 30023},
+			size:  4,
+			want:  []string{"n0", "n1", "n4", "n5"},
+		},
+		{
+			name:   "quotas set each kind's share",
+			notes:  kindNotes(1, 1, 1, 1, 30023, 30023),
+			kinds:  []int{1, 30023},
+			quotas: map[int]float64{1: 0.75, 30023: 0.25},
+			size:   4,
+			want:   []string{"n0", "n1", "n2", "n4"},
+		},
+		{
+			name:   "unset quota takes an even share",
+			notes:  kindNotes(30023, 30023, 30023, 1, 1, 1),
+			kinds:  []int{1, 30023},
+			quotas: map[int]float64{1: 0.75},
+			size:   4,
+			want:   []string{"n0", "n1", "n3", "n4"},
+		},
+		{
+			name:  "slots a kind can't fill go to the best other notes",
+			notes: kindNotes(1, 1, 1, 1, 30023),
+			kinds: []int{1, 30023},
+			size:  4,
+			want:  []string{"n0", "n1", "n2", "n4"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, note := range applyKindQuotas(test.notes, test.kinds, test.quotas, test.size) {
+				got = append(got, note.Event.ID)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("selected %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	nip98MaxAge      = time.Minute // How far an auth event's created_at may be from now
+	nip98MaxBodySize = 1 << 20
+)
+
+type authPubkeyKey struct{}
+
+// usedAuthEvents remembers the IDs of accepted NIP-98 events until they are too
+// old to be accepted again, so a captured Authorization header can't be replayed
+var usedAuthEvents = struct {
+	sync.Mutex
+	expires map[string]time.Time
+}{expires: make(map[string]time.Time)}
+
+// requireAuth only lets signed-in requests through: ones carrying a session
+// from /auth, or signed with a NIP-98 Authorization header by clients that
+// don't keep a session. The caller's pubkey is available from authedPubkey.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pubkey, err := authenticate(r)
+		if err != nil {
+			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), authPubkeyKey{}, pubkey)))
+	}
+}
+
+// readHandler serves data about one user
+type readHandler func(w http.ResponseWriter, r *http.Request, pubkey string)
+
+// requireReadAuth serves the caller's own data, or another user's when the
+// request names them with a pubkey query parameter. Users who turned on
+// RequireAuthForReads only have their data served to themselves.
+func requireReadAuth(next readHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pubkey := r.URL.Query().Get("pubkey")
+		caller, authErr := authenticate(r)
+
+		if pubkey == "" || pubkey == caller {
+			if authErr != nil {
+				http.Error(w, "Unauthorized: "+authErr.Error(), http.StatusUnauthorized)
+				return
+			}
+			next(w, r, caller)
+			return
+		}
+
+		settings, err := repository.GetUserSettings(pubkey)
+		if err != nil {
+			http.Error(w, "Error retrieving settings: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if settings.RequireAuthForReads {
+			http.Error(w, "Forbidden: this user's data is private", http.StatusForbidden)
+			return
+		}
+		next(w, r, pubkey)
+	}
+}
+
+// authedPubkey returns the signed-in caller's pubkey, or "" outside requireAuth
+func authedPubkey(r *http.Request) string {
+	pubkey, _ := r.Context().Value(authPubkeyKey{}).(string)
+	return pubkey
+}
+
+// authenticate returns the caller's pubkey from a NIP-98 header or their session
+func authenticate(r *http.Request) (string, error) {
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Nostr ") {
+		return verifyNIP98(r)
+	}
+
+	token := sessionToken(r)
+	if token == "" {
+		return "", fmt.Errorf("not signed in")
+	}
+	pubkey, err := repository.GetSessionPubkey(token)
+	if err != nil {
+		return "", err
+	}
+	if pubkey == "" {
+		return "", fmt.Errorf("session expired or revoked")
+	}
+	return pubkey, nil
+}
+
+// verifyNIP98 checks the request's "Authorization: Nostr <base64 event>"
+// header: a kind 27235 event signed within the last minute, whose u and method
+// tags match the request and whose payload tag is the SHA-256 of the body.
+// Each event is only accepted once.
+func verifyNIP98(r *http.Request) (string, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !ok {
+		return "", fmt.Errorf("missing Nostr authorization header")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+	if err != nil {
+		return "", fmt.Errorf("authorization header is not base64")
+	}
+	var event nostr.Event
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return "", fmt.Errorf("invalid auth event: %v", err)
+	}
+
+	if event.Kind != nostr.KindHTTPAuth {
+		return "", fmt.Errorf("auth event must be kind %d", nostr.KindHTTPAuth)
+	}
+	if !verifyEvent(&event) {
+		return "", fmt.Errorf("invalid auth event ID or signature")
+	}
+	age := time.Since(event.CreatedAt.Time())
+	if age > nip98MaxAge || age < -nip98MaxAge {
+		return "", fmt.Errorf("auth event is too old or in the future")
+	}
+
+	url, err := requestURL(r)
+	if err != nil {
+		return "", err
+	}
+	if tag := event.Tags.GetFirst([]string{"u", ""}); tag == nil || (*tag)[1] != url {
+		return "", fmt.Errorf("auth event is for a different URL")
+	}
+	if tag := event.Tags.GetFirst([]string{"method", ""}); tag == nil || !strings.EqualFold((*tag)[1], r.Method) {
+		return "", fmt.Errorf("auth event is for a different method")
+	}
+
+	if r.Body != nil {
+		body, err := io.ReadAll(io.LimitReader(r.Body, nip98MaxBodySize))
+		if err != nil {
+			return "", fmt.Errorf("error reading body: %v", err)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if len(body) > 0 {
+			hash := sha256.Sum256(body)
+			tag := event.Tags.GetFirst([]string{"payload", ""})
+			if tag == nil || !strings.EqualFold((*tag)[1], hex.EncodeToString(hash[:])) {
+				return "", fmt.Errorf("auth event payload doesn't match the body")
+			}
+		}
+	}
+
+	if !markAuthEventUsed(event.ID) {
+		return "", fmt.Errorf("auth event was already used")
+	}
+	return event.PubKey, nil
+}
+
+// publicBaseURL is where clients reach the relay, like https://algo.example.com,
+// from PUBLIC_URL
+func publicBaseURL() string {
+	return strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+}
+
+// requestURL is the absolute URL the client called. It is built from
+// PUBLIC_URL rather than the Host header, which the client controls and could
+// set to match an event signed for another site.
+func requestURL(r *http.Request) (string, error) {
+	base := publicBaseURL()
+	if base == "" {
+		return "", fmt.Errorf("NIP-98 auth is disabled until PUBLIC_URL is set")
+	}
+	return base + r.URL.RequestURI(), nil
+}
+
+// markAuthEventUsed returns false if the auth event was already accepted
+func markAuthEventUsed(id string) bool {
+	usedAuthEvents.Lock()
+	defer usedAuthEvents.Unlock()
+
+	if _, ok := usedAuthEvents.expires[id]; ok {
+		return false
+	}
+	// An event can be accepted for nip98MaxAge either side of its created_at
+	usedAuthEvents.expires[id] = time.Now().Add(2 * nip98MaxAge)
+	return true
+}
+
+// expireUsedAuthEvents forgets accepted auth events once they are too old to
+// be accepted again
+func expireUsedAuthEvents(ctx context.Context) {
+	ticker := time.NewTicker(nip98MaxAge)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			usedAuthEvents.Lock()
+			for id, expires := range usedAuthEvents.expires {
+				if now.After(expires) {
+					delete(usedAuthEvents.expires, id)
+				}
+			}
+			usedAuthEvents.Unlock()
+		}
+	}
+}
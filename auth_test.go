@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const testPublicURL = "https://algo.example.com"
+
+// nip98Header signs an auth event for the URL and method, letting the test
+// change it first, and returns the Authorization header for it
+func nip98Header(t *testing.T, secretKey, url, method string, change func(*nostr.Event)) string {
+	t.Helper()
+	event := nostr.Event{
+		Kind:      nostr.KindHTTPAuth,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"u", url}, {"method", method}},
+	}
+	if change != nil {
+		change(&event)
+	}
+	if err := event.Sign(secretKey); err != nil {
+		t.Fatalf("signing auth event: %v", err)
+	}
+	raw, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("encoding auth event: %v", err)
+	}
+	return "Nostr " + base64.StdEncoding.EncodeToString(raw)
+}
+
+func payloadTag(body string) nostr.Tag {
+	hash := sha256.Sum256([]byte(body))
+	return nostr.Tag{"payload", hex.EncodeToString(hash[:])}
+}
+
+func TestVerifyNIP98(t *testing.T) {
+	t.Setenv("PUBLIC_URL", testPublicURL+"/")
+
+	// Signed, then changed so the ID and signature no longer match
+	forged := nostr.Event{Kind: nostr.KindHTTPAuth, CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{{"u", testPublicURL + "/auth"}, {"method", http.MethodGet}}}
+	if err := forged.Sign(nostr.GeneratePrivateKey()); err != nil {
+		t.Fatalf("signing auth event: %v", err)
+	}
+	forged.Content = "changed"
+	forgedJSON, _ := json.Marshal(forged)
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		url     string // Signed URL, the relay's own when empty
+		host    string // Host header, the relay's own when empty
+		change  func(*nostr.Event)
+		header  string // Sent instead of a signed event when set
+		wantErr string
+	}{
+		{
+			name:   "signed GET",
+			method: http.MethodGet,
+			path:   "/api/settings?pubkey=x",
+		},
+		{
+			name:   "signed POST with payload",
+			method: http.MethodPost,
+			path:   "/auth",
+			body:   `{"hello":"world"}`,
+			change: func(e *nostr.Event) { e.Tags = append(e.Tags, payloadTag(`{"hello":"world"}`)) },
+		},
+		{
+			name:    "header isn't base64",
+			method:  http.MethodGet,
+			path:    "/auth",
+			header:  "Nostr not-base64!",
+			wantErr: "not base64",
+		},
+		{
+			name:    "ID and signature don't match",
+			method:  http.MethodGet,
+			path:    "/auth",
+			header:  "Nostr " + base64.StdEncoding.EncodeToString(forgedJSON),
+			wantErr: "ID or signature",
+		},
+		{
+			name:    "wrong kind",
+			method:  http.MethodGet,
+			path:    "/auth",
+			change:  func(e *nostr.Event) { e.Kind = 1 },
+			wantErr: "must be kind",
+		},
+		{
+			name:    "expired",
+			method:  http.MethodGet,
+			path:    "/auth",
+			change:  func(e *nostr.Event) { e.CreatedAt -= 2 * 60 },
+			wantErr: "too old",
+		},
+		{
+			name:    "in the future",
+			method:  http.MethodGet,
+			path:    "/auth",
+			change:  func(e *nostr.Event) { e.CreatedAt += 2 * 60 },
+			wantErr: "in the future",
+		},
+		{
+			name:    "wrong method",
+			method:  http.MethodPost,
+			path:    "/auth",
+			change:  func(e *nostr.Event) { e.Tags[1][1] = http.MethodGet },
+			wantErr: "different method",
+		},
+		{
+			name:    "wrong path",
+			method:  http.MethodGet,
+			path:    "/auth",
+			url:     testPublicURL + "/api/settings",
+			wantErr: "different URL",
+		},
+		{
+			name:    "signed for another site sent with its Host",
+			method:  http.MethodPost,
+			path:    "/auth",
+			url:     "https://other.example.com/auth",
+			host:    "other.example.com",
+			wantErr: "different URL",
+		},
+		{
+			name:    "body without payload tag",
+			method:  http.MethodPost,
+			path:    "/auth",
+			body:    "{}",
+			wantErr: "payload",
+		},
+		{
+			name:    "payload of another body",
+			method:  http.MethodPost,
+			path:    "/auth",
+			body:    "{}",
+			change:  func(e *nostr.Event) { e.Tags = append(e.Tags, payloadTag("[]")) },
+			wantErr: "payload",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			url := test.url
+			if url == "" {
+				url = testPublicURL + test.path
+			}
+			header := test.header
+			if header == "" {
+				header = nip98Header(t, nostr.GeneratePrivateKey(), url, test.method, test.change)
+			}
+
+			request := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			if test.host != "" {
+				request.Host = test.host
+			}
+			request.Header.Set("Authorization", header)
+
+			pubkey, err := verifyNIP98(request)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verifyNIP98: %v", err)
+				}
+				if len(pubkey) != PubkeyLength {
+					t.Errorf("pubkey = %q", pubkey)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("error = %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyNIP98RejectsReplay(t *testing.T) {
+	t.Setenv("PUBLIC_URL", testPublicURL)
+	header := nip98Header(t, nostr.GeneratePrivateKey(), testPublicURL+"/auth", http.MethodPost, nil)
+
+	for i, wantErr := range []bool{false, true} {
+		request := httptest.NewRequest(http.MethodPost, "/auth", nil)
+		request.Header.Set("Authorization", header)
+		if _, err := verifyNIP98(request); (err != nil) != wantErr {
+			t.Errorf("attempt %d: error = %v, want error: %v", i+1, err, wantErr)
+		}
+	}
+}
+
+func TestVerifyNIP98NeedsPublicURL(t *testing.T) {
+	t.Setenv("PUBLIC_URL", "")
+	request := httptest.NewRequest(http.MethodPost, "/auth", nil)
+	request.Header.Set("Authorization", nip98Header(t, nostr.GeneratePrivateKey(), "http://example.com/auth", http.MethodPost, nil))
+
+	if _, err := verifyNIP98(request); err == nil || !strings.Contains(err.Error(), "PUBLIC_URL") {
+		t.Errorf("error = %v, want one about PUBLIC_URL", err)
+	}
+}
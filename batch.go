@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// eventBatch holds rows for the note and engagement tables so many events can
+// be written with one multi-row insert per table
+type eventBatch struct {
+	notes     []noteRow
+	comments  []commentRow
+	reactions []reactionRow
+	zaps      []zapRow
+	replies   []noteRow // Replies are also feed candidates, written to notes alongside their comment row
+	reposts   []repostRow
+	events    int // Events the rows came from. Replies and quotes add more than one row.
+	trackers  []*ingestTracker
+}
+
+type noteRow struct {
+	ID           string
+	AuthorID     string
+	Kind         int
+	Content      string
+	RawJSON      string
+	CreatedAt    nostr.Timestamp
+	Address      string // Set for addressable events
+	RootID       string // Set for replies
+	RootAddress  string
+	ParentID     string
+	ParentAuthor string
+}
+
+type commentRow struct {
+	ID          string
+	NoteID      string // Root of the thread
+	RootAddress string
+	ParentID    string
+	CommenterID string
+	Kind        int
+	Content     string
+	Mentions    []string
+	CreatedAt   nostr.Timestamp
+}
+
+type reactionRow struct {
+	ID           string
+	NoteID       string
+	Address      string
+	ReactorID    string
+	Content      string
+	ReactionType string
+	CreatedAt    nostr.Timestamp
+}
+
+type zapRow struct {
+	ID            string
+	NoteID        string
+	Address       string
+	ZapperID      string
+	Amount        int64
+	ReceiptPubkey string
+	CreatedAt     nostr.Timestamp
+}
+
+// repostRow is a kind 6 or 16 repost, or a q tag quoting the note
+type repostRow struct {
+	ID         string
+	NoteID     string
+	Address    string
+	ReposterID string
+	Kind       int
+	Quote      bool
+	CreatedAt  nostr.Timestamp
+}
+
+// size returns the number of events in the batch
+func (b *eventBatch) size() int {
+	return b.events
+}
+
+func (b *eventBatch) merge(other *eventBatch) {
+	b.notes = append(b.notes, other.notes...)
+	b.comments = append(b.comments, other.comments...)
+	b.reactions = append(b.reactions, other.reactions...)
+	b.zaps = append(b.zaps, other.zaps...)
+	b.replies = append(b.replies, other.replies...)
+	b.reposts = append(b.reposts, other.reposts...)
+	b.events += other.events
+	b.trackers = append(b.trackers, other.trackers...)
+}
+
+// finish tells the trackers of the batch's events that they are written.
+// Rows aren't matched back to events, so one failure fails every tracker.
+func (b *eventBatch) finish(failed bool) {
+	for _, tracker := range b.trackers {
+		if failed {
+			tracker.failed.Store(true)
+		}
+		tracker.Done()
+	}
+}
+
+// split returns a batch per event, with all the rows of that event
+func (b *eventBatch) split() []*eventBatch {
+	var batches []*eventBatch
+	byID := make(map[string]*eventBatch)
+	single := func(id string) *eventBatch {
+		if batch, ok := byID[id]; ok {
+			return batch
+		}
+		batch := &eventBatch{events: 1}
+		byID[id] = batch
+		batches = append(batches, batch)
+		return batch
+	}
+
+	for _, note := range b.notes {
+		single(note.ID).notes = append(single(note.ID).notes, note)
+	}
+	for _, comment := range b.comments {
+		single(comment.ID).comments = append(single(comment.ID).comments, comment)
+	}
+	for _, reaction := range b.reactions {
+		single(reaction.ID).reactions = append(single(reaction.ID).reactions, reaction)
+	}
+	for _, zap := range b.zaps {
+		single(zap.ID).zaps = append(single(zap.ID).zaps, zap)
+	}
+	for _, reply := range b.replies {
+		single(reply.ID).replies = append(single(reply.ID).replies, reply)
+	}
+	for _, repost := range b.reposts {
+		single(repost.ID).reposts = append(single(repost.ID).reposts, repost)
+	}
+	return batches
+}
+
+// isBatchedKind reports whether events of the kind are written through an
+// eventBatch. Other kinds replace or delete rows and are saved one at a time.
+func isBatchedKind(kind int) bool {
+	switch kind {
+	case 3, 10000, 1984, 5, 0, 10002:
+		return false
+	}
+	return true
+}
+
+// addToBatch validates a note, comment, reaction, zap or repost and adds its
+// rows to the batch
+func (r *NostrRepository) addToBatch(event *nostr.Event, batch *eventBatch) error {
+	if err := r.addRows(event, batch); err != nil {
+		return err
+	}
+	batch.events++
+	return nil
+}
+
+func (r *NostrRepository) addRows(event *nostr.Event, batch *eventBatch) error {
+	switch event.Kind {
+	case 1, 2, 1111: // Note, reply or NIP-22 comment
+		if ref, ok := parseThread(event); ok {
+			batch.replies = append(batch.replies, noteRow{
+				ID:           event.ID,
+				AuthorID:     event.PubKey,
+				Kind:         event.Kind,
+				Content:      event.Content,
+				RawJSON:      event.String(),
+				CreatedAt:    event.CreatedAt,
+				RootID:       ref.RootID,
+				RootAddress:  ref.RootAddress,
+				ParentID:     ref.ParentID,
+				ParentAuthor: ref.ParentAuthor,
+			})
+			batch.comments = append(batch.comments, commentRow{
+				ID:          event.ID,
+				NoteID:      ref.RootID,
+				RootAddress: ref.RootAddress,
+				ParentID:    ref.ParentID,
+				CommenterID: event.PubKey,
+				Kind:        event.Kind,
+				Content:     event.Content,
+				Mentions:    ref.Mentions,
+				CreatedAt:   event.CreatedAt,
+			})
+			batch.reposts = append(batch.reposts, quoteRows(event)...)
+			return nil
+		}
+		if event.Kind == 1111 {
+			return fmt.Errorf("comment %s has no root note", event.ID)
+		}
+	case 7: // Reaction
+		noteID, address, err := getEngagedNote(event)
+		if err != nil {
+			return err
+		}
+		batch.reactions = append(batch.reactions, reactionRow{
+			ID:           event.ID,
+			NoteID:       noteID,
+			Address:      address,
+			ReactorID:    event.PubKey,
+			Content:      event.Content,
+			ReactionType: reactionType(event.Content),
+			CreatedAt:    event.CreatedAt,
+		})
+		return nil
+	case 9735: // Zap
+		noteID, address, err := getEngagedNote(event)
+		if err != nil {
+			return err
+		}
+		zap, err := r.validateZapReceipt(event)
+		if err != nil {
+			return err
+		}
+		batch.zaps = append(batch.zaps, zapRow{
+			ID:            event.ID,
+			NoteID:        noteID,
+			Address:       address,
+			ZapperID:      zap.ZapperID,
+			Amount:        zap.Amount,
+			ReceiptPubkey: event.PubKey,
+			CreatedAt:     event.CreatedAt,
+		})
+		return nil
+	case 6, 16: // Repost or generic repost
+		noteID, address, err := getEngagedNote(event)
+		if err != nil {
+			return err
+		}
+		batch.reposts = append(batch.reposts, repostRow{
+			ID:         event.ID,
+			NoteID:     noteID,
+			Address:    address,
+			ReposterID: event.PubKey,
+			Kind:       event.Kind,
+			CreatedAt:  event.CreatedAt,
+		})
+		return nil
+	}
+
+	note := noteRow{
+		ID:        event.ID,
+		AuthorID:  event.PubKey,
+		Kind:      event.Kind,
+		Content:   event.Content,
+		RawJSON:   event.String(),
+		CreatedAt: event.CreatedAt,
+	}
+	if isAddressable(event.Kind) {
+		note.Address = eventAddress(event)
+	}
+	batch.notes = append(batch.notes, note)
+	batch.reposts = append(batch.reposts, quoteRows(event)...)
+	return nil
+}
+
+// quoteRows returns a row for each note the event quotes with a q tag (NIP-18),
+// which names either an event ID or an address
+func quoteRows(event *nostr.Event) []repostRow {
+	var rows []repostRow
+	seen := make(map[string]bool)
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "q" || seen[tag[1]] {
+			continue
+		}
+		var noteID, address string
+		if nostr.IsValid32ByteHex(tag[1]) {
+			noteID = tag[1]
+		} else if _, ok := parseAddress(tag[1]); ok {
+			address = tag[1]
+		} else {
+			continue
+		}
+		seen[tag[1]] = true
+		rows = append(rows, repostRow{
+			ID:         event.ID,
+			NoteID:     noteID,
+			Address:    address,
+			ReposterID: event.PubKey,
+			Kind:       event.Kind,
+			Quote:      true,
+			CreatedAt:  event.CreatedAt,
+		})
+	}
+	return rows
+}
+
+// insertBatch writes the batch in one transaction. Notes go first so engagement
+// in the same batch can reference them. Engagement on unknown notes and events
+// their author asked to delete are skipped rather than failing the batch.
+// Engagement naming an address goes to the stored revision of that address.
+func (r *NostrRepository) insertBatch(ctx context.Context, batch *eventBatch) error {
+	if batch.size() == 0 {
+		return nil
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Replies go after the other notes so a reply can find a root in the same batch
+	replaced, err := insertNotes(ctx, tx, batch.notes)
+	if err != nil {
+		return err
+	}
+	if _, err := insertNotes(ctx, tx, batch.replies); err != nil {
+		return err
+	}
+
+	if len(batch.comments) > 0 {
+		var ids, noteIDs, addresses, parentIDs, commenters, contents, mentions []string
+		var kinds, createdAt []int64
+		for _, comment := range batch.comments {
+			ids = append(ids, comment.ID)
+			noteIDs = append(noteIDs, comment.NoteID)
+			addresses = append(addresses, comment.RootAddress)
+			parentIDs = append(parentIDs, comment.ParentID)
+			commenters = append(commenters, comment.CommenterID)
+			kinds = append(kinds, int64(comment.Kind))
+			contents = append(contents, comment.Content)
+			// Arrays of arrays must be rectangular, so mentions travel as one
+			// comma separated string per comment
+			mentions = append(mentions, strings.Join(comment.Mentions, ","))
+			createdAt = append(createdAt, int64(comment.CreatedAt))
+		}
+
+		// Replies to the root are depth 1. Deeper replies are one below their
+		// parent, or depth 2 when the parent isn't stored yet. Comments that
+		// only name the root's address reply to the root.
+		query := `
+			INSERT INTO comments (id, note_id, parent_id, depth, commenter_id, kind, content, mentions, created_at)
+			SELECT c.id, t.note_id, COALESCE(NULLIF(c.parent_id, ''), t.note_id),
+				CASE WHEN c.parent_id IN ('', c.note_id, t.note_id) THEN 1
+					ELSE COALESCE((SELECT p.depth + 1 FROM comments p WHERE p.id = c.parent_id), 2)
+				END,
+				c.commenter_id, c.kind, c.content, COALESCE(string_to_array(NULLIF(c.mentions, ''), ','), '{}'),
+				to_timestamp(c.created_at)
+			FROM unnest($1::text[], $2::text[], $3::text[], $4::text[], $5::int[], $6::text[], $7::text[], $8::bigint[], $9::text[])
+				AS c(id, note_id, parent_id, commenter_id, kind, content, mentions, created_at, address)
+			CROSS JOIN LATERAL (
+				SELECT note_id_for(c.address, c.note_id) AS note_id
+			) t
+			WHERE EXISTS (SELECT 1 FROM notes n WHERE n.id = t.note_id)
+			AND NOT EXISTS (SELECT 1 FROM deletions d WHERE d.event_id = c.id AND d.deleter_id = c.commenter_id)
+			ON CONFLICT (id) DO NOTHING;
+		`
+		if _, err := tx.ExecContext(ctx, query, pq.Array(ids), pq.Array(noteIDs), pq.Array(parentIDs),
+			pq.Array(commenters), pq.Array(kinds), pq.Array(contents), pq.Array(mentions),
+			pq.Array(createdAt), pq.Array(addresses)); err != nil {
+			return fmt.Errorf("failed to insert comments: %v", err)
+		}
+	}
+
+	if len(batch.reactions) > 0 {
+		var ids, noteIDs, addresses, reactors, contents, types []string
+		var createdAt []int64
+		for _, reaction := range batch.reactions {
+			ids = append(ids, reaction.ID)
+			noteIDs = append(noteIDs, reaction.NoteID)
+			addresses = append(addresses, reaction.Address)
+			reactors = append(reactors, reaction.ReactorID)
+			contents = append(contents, reaction.Content)
+			types = append(types, reaction.ReactionType)
+			createdAt = append(createdAt, int64(reaction.CreatedAt))
+		}
+
+		query := `
+			INSERT INTO reactions (id, note_id, reactor_id, content, reaction_type, created_at)
+			SELECT r.id, t.note_id, r.reactor_id, r.content, r.reaction_type, to_timestamp(r.created_at)
+			FROM unnest($1::text[], $2::text[], $3::text[], $4::text[], $5::text[], $6::bigint[], $7::text[])
+				AS r(id, note_id, reactor_id, content, reaction_type, created_at, address)
+			CROSS JOIN LATERAL (
+				SELECT note_id_for(r.address, r.note_id) AS note_id
+			) t
+			WHERE EXISTS (SELECT 1 FROM notes n WHERE n.id = t.note_id)
+			AND NOT EXISTS (SELECT 1 FROM deletions d WHERE d.event_id = r.id AND d.deleter_id = r.reactor_id)
+			ON CONFLICT (id) DO NOTHING;
+		`
+		if _, err := tx.ExecContext(ctx, query, pq.Array(ids), pq.Array(noteIDs), pq.Array(reactors),
+			pq.Array(contents), pq.Array(types), pq.Array(createdAt), pq.Array(addresses)); err != nil {
+			return fmt.Errorf("failed to insert reactions: %v", err)
+		}
+	}
+
+	if len(batch.zaps) > 0 {
+		var ids, noteIDs, addresses, zappers, receiptPubkeys []string
+		var amounts, createdAt []int64
+		for _, zap := range batch.zaps {
+			ids = append(ids, zap.ID)
+			noteIDs = append(noteIDs, zap.NoteID)
+			addresses = append(addresses, zap.Address)
+			zappers = append(zappers, zap.ZapperID)
+			amounts = append(amounts, zap.Amount)
+			receiptPubkeys = append(receiptPubkeys, zap.ReceiptPubkey)
+			createdAt = append(createdAt, int64(zap.CreatedAt))
+		}
+
+		query := `
+			INSERT INTO zaps (id, note_id, zapper_id, amount, receipt_pubkey, created_at)
+			SELECT z.id, t.note_id, z.zapper_id, z.amount, z.receipt_pubkey, to_timestamp(z.created_at)
+			FROM unnest($1::text[], $2::text[], $3::text[], $4::bigint[], $5::text[], $6::bigint[], $7::text[])
+				AS z(id, note_id, zapper_id, amount, receipt_pubkey, created_at, address)
+			CROSS JOIN LATERAL (
+				SELECT note_id_for(z.address, z.note_id) AS note_id
+			) t
+			WHERE EXISTS (SELECT 1 FROM notes n WHERE n.id = t.note_id)
+			AND NOT EXISTS (SELECT 1 FROM deletions d WHERE d.event_id = z.id AND d.deleter_id = z.receipt_pubkey)
+			ON CONFLICT (id) DO NOTHING;
+		`
+		if _, err := tx.ExecContext(ctx, query, pq.Array(ids), pq.Array(noteIDs), pq.Array(zappers),
+			pq.Array(amounts), pq.Array(receiptPubkeys), pq.Array(createdAt), pq.Array(addresses)); err != nil {
+			return fmt.Errorf("failed to insert zaps: %v", err)
+		}
+	}
+
+	if len(batch.reposts) > 0 {
+		var ids, noteIDs, addresses, reposters []string
+		var kinds, createdAt []int64
+		var quotes []bool
+		for _, repost := range batch.reposts {
+			ids = append(ids, repost.ID)
+			noteIDs = append(noteIDs, repost.NoteID)
+			addresses = append(addresses, repost.Address)
+			reposters = append(reposters, repost.ReposterID)
+			kinds = append(kinds, int64(repost.Kind))
+			quotes = append(quotes, repost.Quote)
+			createdAt = append(createdAt, int64(repost.CreatedAt))
+		}
+
+		query := `
+			INSERT INTO reposts (id, note_id, reposter_id, kind, quote, created_at)
+			SELECT r.id, t.note_id, r.reposter_id, r.kind, r.quote, to_timestamp(r.created_at)
+			FROM unnest($1::text[], $2::text[], $3::text[], $4::int[], $5::bool[], $6::bigint[], $7::text[])
+				AS r(id, note_id, reposter_id, kind, quote, created_at, address)
+			CROSS JOIN LATERAL (
+				SELECT note_id_for(r.address, r.note_id) AS note_id
+			) t
+			WHERE EXISTS (SELECT 1 FROM notes n WHERE n.id = t.note_id)
+			AND NOT EXISTS (SELECT 1 FROM deletions d WHERE d.event_id = r.id AND d.deleter_id = r.reposter_id)
+			ON CONFLICT (id, note_id) DO NOTHING;
+		`
+		if _, err := tx.ExecContext(ctx, query, pq.Array(ids), pq.Array(noteIDs), pq.Array(reposters),
+			pq.Array(kinds), pq.Array(quotes), pq.Array(createdAt), pq.Array(addresses)); err != nil {
+			return fmt.Errorf("failed to insert reposts: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	if len(replaced) > 0 {
+		invalidateFeedsContaining(replaced)
+	}
+	return nil
+}
+
+// insertNotes writes note rows. Replies are only kept when their root is known,
+// so clients can always fetch the thread they belong to. Addressable notes
+// replace older revisions, whose IDs are returned.
+func insertNotes(ctx context.Context, tx *sql.Tx, notes []noteRow) ([]string, error) {
+	var replaced []string
+	var ids, authors, contents, raw, rootIDs, rootAddresses, parentIDs, parentAuthors []string
+	var kinds, createdAt []int64
+	for _, note := range notes {
+		if note.Address != "" {
+			replacedID, err := replaceAddressable(ctx, tx, note)
+			if err != nil {
+				return nil, err
+			}
+			if replacedID != "" {
+				replaced = append(replaced, replacedID)
+			}
+			continue
+		}
+		ids = append(ids, note.ID)
+		authors = append(authors, note.AuthorID)
+		kinds = append(kinds, int64(note.Kind))
+		contents = append(contents, note.Content)
+		raw = append(raw, note.RawJSON)
+		createdAt = append(createdAt, int64(note.CreatedAt))
+		rootIDs = append(rootIDs, note.RootID)
+		rootAddresses = append(rootAddresses, note.RootAddress)
+		parentIDs = append(parentIDs, note.ParentID)
+		parentAuthors = append(parentAuthors, note.ParentAuthor)
+	}
+
+	if len(ids) == 0 {
+		return replaced, nil
+	}
+
+	// A reply naming its root by address joins the root's latest revision
+	query := `
+		INSERT INTO notes (id, author_id, kind, content, raw_json, created_at, root_id, parent_id, parent_author_id)
+		SELECT n.id, n.author_id, n.kind, n.content, n.raw_json::jsonb, to_timestamp(n.created_at),
+			NULLIF(t.root_id, ''), COALESCE(NULLIF(n.parent_id, ''), NULLIF(t.root_id, '')),
+			COALESCE((SELECT p.author_id FROM notes p WHERE p.id = COALESCE(NULLIF(n.parent_id, ''), t.root_id)),
+				NULLIF(n.parent_author, ''))
+		FROM unnest($1::text[], $2::text[], $3::int[], $4::text[], $5::text[], $6::bigint[], $7::text[], $8::text[], $9::text[], $10::text[])
+			AS n(id, author_id, kind, content, raw_json, created_at, root_id, parent_id, parent_author, root_address)
+		CROSS JOIN LATERAL (
+			SELECT note_id_for(n.root_address, n.root_id) AS root_id
+		) t
+		WHERE NOT EXISTS (SELECT 1 FROM deletions d WHERE d.event_id = n.id AND d.deleter_id = n.author_id)
+		AND (n.root_id = '' AND n.root_address = '' OR EXISTS (SELECT 1 FROM notes r WHERE r.id = t.root_id))
+		ON CONFLICT (id) DO NOTHING;
+	`
+	if _, err := tx.ExecContext(ctx, query, pq.Array(ids), pq.Array(authors), pq.Array(kinds),
+		pq.Array(contents), pq.Array(raw), pq.Array(createdAt), pq.Array(rootIDs), pq.Array(parentIDs),
+		pq.Array(parentAuthors), pq.Array(rootAddresses)); err != nil {
+		return nil, fmt.Errorf("failed to insert notes: %v", err)
+	}
+	return replaced, nil
+}
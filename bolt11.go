@@ -1,9 +1,15 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"math/big"
 	"regexp"
+	"strings"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
 )
 
 var (
@@ -17,8 +23,236 @@ var (
 	maxMillisats, _ = big.NewInt(0).SetString("2100000000000000000", 10)
 )
 
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// BOLT #11 tagged field types we care about
+const (
+	bolt11FieldPaymentHash     = 1
+	bolt11FieldDescription     = 13
+	bolt11FieldPayee           = 19
+	bolt11FieldDescriptionHash = 23
+)
+
+const (
+	bolt11TimestampLength = 7   // 35 bit timestamp, in 5-bit groups
+	bolt11SignatureLength = 104 // 64 byte signature plus recovery id, in 5-bit groups
+)
+
+// Bolt11Invoice holds the parts of a lightning invoice needed to validate zaps
+type Bolt11Invoice struct {
+	Network         string
+	MilliSats       *big.Int // nil when the invoice has no amount
+	Timestamp       int64
+	PaymentHash     string
+	Description     string
+	DescriptionHash string
+	Payee           string // Hex encoded compressed node pubkey
+}
+
+// decodeBolt11 decodes a BOLT #11 invoice and checks its signature. The payee
+// is recovered from the signature when the invoice doesn't state it.
+func decodeBolt11(invoice string) (*Bolt11Invoice, error) {
+	hrp, data, err := decodeBech32(invoice)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(hrp, "ln") {
+		return nil, errors.New("not a lightning invoice")
+	}
+	if len(data) < bolt11TimestampLength+bolt11SignatureLength {
+		return nil, errors.New("invoice is too short")
+	}
+
+	decoded := &Bolt11Invoice{}
+	network := strings.TrimPrefix(hrp, "ln")
+	if i := strings.IndexAny(network, "0123456789"); i >= 0 {
+		decoded.Network = network[:i]
+		decoded.MilliSats, err = hrpToMillisat(hrp)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		decoded.Network = network
+	}
+
+	signed := data[:len(data)-bolt11SignatureLength]
+	for _, group := range signed[:bolt11TimestampLength] {
+		decoded.Timestamp = decoded.Timestamp<<5 | int64(group)
+	}
+
+	fields := signed[bolt11TimestampLength:]
+	for len(fields) >= 3 {
+		fieldType := fields[0]
+		length := int(fields[1])<<5 | int(fields[2])
+		if len(fields) < 3+length {
+			return nil, errors.New("invoice field overruns the data")
+		}
+		value := fields[3 : 3+length]
+		fields = fields[3+length:]
+
+		// Fields with an unexpected length must be skipped, not rejected
+		switch fieldType {
+		case bolt11FieldPaymentHash:
+			if length == 52 {
+				decoded.PaymentHash = hexFromGroups(value)
+			}
+		case bolt11FieldDescriptionHash:
+			if length == 52 {
+				decoded.DescriptionHash = hexFromGroups(value)
+			}
+		case bolt11FieldPayee:
+			if length == 53 {
+				decoded.Payee = hexFromGroups(value)
+			}
+		case bolt11FieldDescription:
+			description, err := convertBits(value, 5, 8, false)
+			if err != nil {
+				return nil, fmt.Errorf("invalid description: %v", err)
+			}
+			decoded.Description = string(description)
+		}
+	}
+
+	if decoded.PaymentHash == "" {
+		return nil, errors.New("invoice has no payment hash")
+	}
+
+	signature, err := convertBits(data[len(data)-bolt11SignatureLength:], 5, 8, false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %v", err)
+	}
+	signedBytes, err := convertBits(signed, 5, 8, true)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(append([]byte(hrp), signedBytes...))
+
+	payee, err := recoverBolt11Payee(signature, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	if decoded.Payee != "" && decoded.Payee != payee {
+		return nil, errors.New("invoice signature does not match the payee")
+	}
+	decoded.Payee = payee
+
+	return decoded, nil
+}
+
+func recoverBolt11Payee(signature []byte, hash []byte) (string, error) {
+	if len(signature) != 65 || signature[64] > 3 {
+		return "", errors.New("invalid invoice signature")
+	}
+
+	// RecoverCompact expects the recovery id up front, flagged as compressed
+	compact := make([]byte, 65)
+	compact[0] = 27 + 4 + signature[64]
+	copy(compact[1:], signature[:64])
+
+	pubkey, _, err := ecdsa.RecoverCompact(compact, hash)
+	if err != nil {
+		return "", fmt.Errorf("invalid invoice signature: %v", err)
+	}
+	return hex.EncodeToString(pubkey.SerializeCompressed()), nil
+}
+
+func hexFromGroups(groups []byte) string {
+	value, err := convertBits(groups, 5, 8, false)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(value)
+}
+
+// decodeBech32 splits a bech32 string into its human-readable part and data
+// groups. Unlike BIP-173 there is no length limit, invoices are often longer.
+func decodeBech32(encoded string) (string, []byte, error) {
+	if strings.ToLower(encoded) != encoded && strings.ToUpper(encoded) != encoded {
+		return "", nil, errors.New("bech32 string has mixed case")
+	}
+	encoded = strings.ToLower(encoded)
+
+	separator := strings.LastIndexByte(encoded, '1')
+	if separator < 1 || separator+7 > len(encoded) {
+		return "", nil, errors.New("invalid bech32 separator position")
+	}
+
+	hrp := encoded[:separator]
+	data := make([]byte, 0, len(encoded)-separator-1)
+	for _, c := range encoded[separator+1:] {
+		value := strings.IndexRune(bech32Charset, c)
+		if value < 0 {
+			return "", nil, fmt.Errorf("invalid bech32 character %q", c)
+		}
+		data = append(data, byte(value))
+	}
+
+	if bech32Polymod(append(bech32ExpandHRP(hrp), data...)) != 1 {
+		return "", nil, errors.New("invalid bech32 checksum")
+	}
+
+	return hrp, data[:len(data)-6], nil
+}
+
+func bech32Polymod(values []byte) uint32 {
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	checksum := uint32(1)
+	for _, value := range values {
+		top := checksum >> 25
+		checksum = (checksum&0x1ffffff)<<5 ^ uint32(value)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				checksum ^= generator[i]
+			}
+		}
+	}
+	return checksum
+}
+
+func bech32ExpandHRP(hrp string) []byte {
+	expanded := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]>>5)
+	}
+	expanded = append(expanded, 0)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]&31)
+	}
+	return expanded
+}
+
+// convertBits regroups data between bit widths, e.g. bech32 5-bit groups to bytes
+func convertBits(data []byte, fromBits, toBits uint, pad bool) ([]byte, error) {
+	var accumulator uint32
+	var bits uint
+	maxValue := uint32(1)<<toBits - 1
+
+	converted := make([]byte, 0, len(data)*int(fromBits)/int(toBits)+1)
+	for _, value := range data {
+		if uint32(value)>>fromBits != 0 {
+			return nil, errors.New("invalid data range")
+		}
+		accumulator = accumulator<<fromBits | uint32(value)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			converted = append(converted, byte(accumulator>>bits&maxValue))
+		}
+	}
+
+	if pad {
+		if bits > 0 {
+			converted = append(converted, byte(accumulator<<(toBits-bits)&maxValue))
+		}
+	} else if bits >= fromBits {
+		return nil, errors.New("invalid padding")
+	}
+
+	return converted, nil
+}
+
 func hrpToMillisat(hrp string) (*big.Int, error) {
-	re := regexp.MustCompile(`^ln[a-z]{2}(\d+[munp]?)`)
+	re := regexp.MustCompile(`^ln[a-z]+?(\d+[munp]?)$`)
 	matches := re.FindStringSubmatch(hrp)
 	if matches == nil || len(matches) < 2 {
 		return nil, errors.New("not a valid human-readable amount")
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// Test vectors from BOLT #11, all signed by the same node
+const bolt11TestPayee = "03e7156ae33b0a208d0744199163177e909e80176e55d97a2f221ede0f934dd9ad"
+const bolt11TestPaymentHash = "0001020304050607080900010203040506070809000102030405060708090102"
+
+func TestDecodeBolt11(t *testing.T) {
+	descriptionHash := sha256.Sum256([]byte("One piece of chocolate cake, one icecream cone, one pickle, one slice of swiss cheese, one slice of salami, one lollypop, one piece of cherry pie, one sausage, one cupcake, and one slice of watermelon"))
+
+	tests := []struct {
+		name            string
+		invoice         string
+		milliSats       int64 // -1 for no amount
+		description     string
+		descriptionHash string
+	}{
+		{
+			name:        "donation without amount",
+			invoice:     "lnbc1pvjluezsp5zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zygspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdpl2pkx2ctnv5sxxmmwwd5kgetjypeh2ursdae8g6twvus8g6rfwvs8qun0dfjkxaq9qrsgq357wnc5r2ueh7ck6q93dj32dlqnls087fxdwk8qakdyafkq3yap9us6v52vjjsrvywa6rt52cm9r9zqt8r2t7mlcwspyetp5h2tztugp9lfyql",
+			milliSats:   -1,
+			description: "Please consider supporting this project",
+		},
+		{
+			name:        "coffee with amount and expiry",
+			invoice:     "lnbc2500u1pvjluezsp5zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zygspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdq5xysxxatsyp3k7enxv4jsxqzpu9qrsgquk0rl77nj30yxdy8j9vdx85fkpmdla2087ne0xh8nhedh8w27kyke0lp53ut353s06fv3qfegext0eh0ymjpf39tuven09sam30g4vgpfna3rh",
+			milliSats:   250000000,
+			description: "1 cup coffee",
+		},
+		{
+			name:            "description hash",
+			invoice:         "lnbc20m1pvjluezsp5zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zygspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqhp58yjmdan79s6qqdhdzgynm4zwqd5d7xmw5fk98klysy043l2ahrqs9qrsgq7ea976txfraylvgzuxs8kgcw23ezlrszfnh8r6qtfpr6cxga50aj6txm9rxrydzd06dfeawfk6swupvz4erwnyutnjq7x39ymw6j38gp7ynn44",
+			milliSats:       2000000000,
+			descriptionHash: hex.EncodeToString(descriptionHash[:]),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			invoice, err := decodeBolt11(test.invoice)
+			if err != nil {
+				t.Fatalf("decodeBolt11: %v", err)
+			}
+
+			if test.milliSats < 0 {
+				if invoice.MilliSats != nil {
+					t.Errorf("amount = %s, want none", invoice.MilliSats)
+				}
+			} else if invoice.MilliSats == nil || invoice.MilliSats.Int64() != test.milliSats {
+				t.Errorf("amount = %v, want %d", invoice.MilliSats, test.milliSats)
+			}
+
+			if invoice.Network != "bc" {
+				t.Errorf("network = %q, want bc", invoice.Network)
+			}
+			if invoice.Timestamp != 1496314658 {
+				t.Errorf("timestamp = %d, want 1496314658", invoice.Timestamp)
+			}
+			if invoice.Payee != bolt11TestPayee {
+				t.Errorf("payee = %s, want %s", invoice.Payee, bolt11TestPayee)
+			}
+			if invoice.PaymentHash != bolt11TestPaymentHash {
+				t.Errorf("payment hash = %s, want %s", invoice.PaymentHash, bolt11TestPaymentHash)
+			}
+			if invoice.Description != test.description {
+				t.Errorf("description = %q, want %q", invoice.Description, test.description)
+			}
+			if invoice.DescriptionHash != test.descriptionHash {
+				t.Errorf("description hash = %s, want %s", invoice.DescriptionHash, test.descriptionHash)
+			}
+		})
+	}
+}
+
+func TestDecodeBolt11RejectsBadInvoices(t *testing.T) {
+	valid := "lnbc2500u1pvjluezsp5zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zygspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdq5xysxxatsyp3k7enxv4jsxqzpu9qrsgquk0rl77nj30yxdy8j9vdx85fkpmdla2087ne0xh8nhedh8w27kyke0lp53ut353s06fv3qfegext0eh0ymjpf39tuven09sam30g4vgpfna3rh"
+
+	tests := map[string]string{
+		"bad checksum":  valid[:len(valid)-1] + "q",
+		"mixed case":    "LNBC" + valid[4:],
+		"not lightning": "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4",
+	}
+	for name, invoice := range tests {
+		if _, err := decodeBolt11(invoice); err == nil {
+			t.Errorf("%s: decodeBolt11 accepted an invalid invoice", name)
+		}
+	}
+}
+
+func TestHrpToMillisat(t *testing.T) {
+	tests := map[string]int64{
+		"lnbc20m":   2000000000,
+		"lnbc2500u": 250000000,
+		"lnbc10n":   1000,
+		"lnbc10p":   1,
+		"lntb1":     100000000000,
+	}
+	for hrp, want := range tests {
+		got, err := hrpToMillisat(hrp)
+		if err != nil {
+			t.Errorf("%s: %v", hrp, err)
+		} else if got.Int64() != want {
+			t.Errorf("%s = %s millisats, want %d", hrp, got, want)
+		}
+	}
+
+	for _, hrp := range []string{"lnbc2500x", "lnbc", "lnbcm"} {
+		if _, err := hrpToMillisat(hrp); err == nil {
+			t.Errorf("%s: hrpToMillisat accepted an invalid amount", hrp)
+		}
+	}
+}
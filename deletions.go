@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// saveDeletion processes a NIP-09 deletion request (kind 5). Only events
+// authored by the deleter are removed, and the request is remembered so that
+// copies of the deleted events arriving later are rejected. An a tag deletes
+// the revisions of the address up to the time of the request.
+func (r *NostrRepository) saveDeletion(event *nostr.Event) error {
+	var eventIDs, addresses []string
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "e":
+			eventIDs = append(eventIDs, tag[1])
+		case "a":
+			if pubkey, ok := parseAddress(tag[1]); ok && pubkey == event.PubKey {
+				addresses = append(addresses, tag[1])
+			}
+		}
+	}
+
+	if len(eventIDs) == 0 && len(addresses) == 0 {
+		return fmt.Errorf("no event IDs or addresses found in deletion request")
+	}
+
+	ctx := context.Background()
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rememberQuery := `
+		INSERT INTO deletions (event_id, deleter_id, deletion_id, created_at)
+		SELECT unnest($1::text[]), $2, $3, to_timestamp($4)
+		ON CONFLICT (event_id, deleter_id) DO UPDATE SET
+			deletion_id = EXCLUDED.deletion_id,
+			created_at = EXCLUDED.created_at
+		WHERE deletions.created_at < EXCLUDED.created_at;
+	`
+	remembered := append(append([]string(nil), eventIDs...), addresses...)
+	if _, err := tx.ExecContext(ctx, rememberQuery, pq.Array(remembered), event.PubKey, event.ID, event.CreatedAt); err != nil {
+		return fmt.Errorf("failed to record deletion: %v", err)
+	}
+
+	if len(addresses) > 0 {
+		addressQuery := `
+			SELECT id FROM notes
+			WHERE address = ANY($1) AND author_id = $2 AND created_at <= to_timestamp($3)
+		`
+		rows, err := tx.QueryContext(ctx, addressQuery, pq.Array(addresses), event.PubKey, event.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to look up deleted addresses: %v", err)
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			eventIDs = append(eventIDs, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	// Engagement on a deleted note goes with it, like when purging old notes
+	deleteQueries := []string{
+		`DELETE FROM reactions WHERE note_id IN (SELECT id FROM notes WHERE id = ANY($1) AND author_id = $2)`,
+		`DELETE FROM comments WHERE note_id IN (SELECT id FROM notes WHERE id = ANY($1) AND author_id = $2)`,
+		`DELETE FROM zaps WHERE note_id IN (SELECT id FROM notes WHERE id = ANY($1) AND author_id = $2)`,
+		`DELETE FROM reposts WHERE note_id IN (SELECT id FROM notes WHERE id = ANY($1) AND author_id = $2)`,
+		`DELETE FROM notes WHERE id = ANY($1) AND author_id = $2`,
+		`DELETE FROM reactions WHERE id = ANY($1) AND reactor_id = $2`,
+		`DELETE FROM comments WHERE id = ANY($1) AND commenter_id = $2`,
+		`DELETE FROM zaps WHERE id = ANY($1) AND receipt_pubkey = $2`,
+		`DELETE FROM reposts WHERE id = ANY($1) AND reposter_id = $2`,
+		`DELETE FROM reports WHERE id = ANY($1) AND reporter_id = $2`,
+	}
+
+	var rowsDeleted int64
+	for _, query := range deleteQueries {
+		result, err := tx.ExecContext(ctx, query, pq.Array(eventIDs), event.PubKey)
+		if err != nil {
+			return fmt.Errorf("failed to apply deletion: %v", err)
+		}
+		rowsAffected, _ := result.RowsAffected()
+		rowsDeleted += rowsAffected
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	if rowsDeleted > 0 {
+		log.Printf("Deletion %s removed %d rows", event.ID, rowsDeleted)
+		invalidateFeedsContaining(eventIDs)
+	}
+	return nil
+}
+
+// isDeleted reports whether the event's author has already asked for it to be
+// deleted, by ID or, for addressable events, by an address deletion made after
+// it was created
+func (r *NostrRepository) isDeleted(event *nostr.Event) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM deletions
+			WHERE deleter_id = $2 AND (event_id = $1 OR (event_id = $3 AND created_at >= to_timestamp($4)))
+		)
+	`
+	var address string
+	if isAddressable(event.Kind) {
+		address = eventAddress(event)
+	}
+
+	var deleted bool
+	err := r.db.QueryRowContext(context.Background(), query, event.ID, event.PubKey, address, event.CreatedAt).Scan(&deleted)
+	return deleted, err
+}
+
+func (r *NostrRepository) PurgeDeletionsOlderThan(months int) error {
+	cutoffDate := time.Now().AddDate(0, -months, 0)
+	query := `
+        DELETE FROM deletions
+        WHERE created_at < $1;
+    `
+	result, err := r.db.ExecContext(context.Background(), query, cutoffDate)
+	if err != nil {
+		return fmt.Errorf("failed to purge deletions: %v", err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	fmt.Printf("Purged %d deletions older than %d months\n", rowsAffected, months)
+	return nil
+}
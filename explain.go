@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const explainContentLength = 140 // Characters of the note shown next to its breakdown
+
+// ScoreBreakdown records what each part of the ranking added to a note's
+// score. Penalties are negative, and the parts add up to Total.
+type ScoreBreakdown struct {
+	Source           string  `json:"source"` // "author" for the user's network, "viral" for the shared viral pool
+	Comments         float64 `json:"comments"`
+	DirectReplies    float64 `json:"directReplies"`
+	Reactions        float64 `json:"reactions"`
+	EmojiReactions   float64 `json:"emojiReactions"`
+	Dislikes         float64 `json:"dislikes"`
+	Zaps             float64 `json:"zaps"`
+	ZapAmount        float64 `json:"zapAmount"`
+	Reposts          float64 `json:"reposts"`
+	Recency          float64 `json:"recency"`
+	AuthorAffinity   float64 `json:"authorAffinity"`
+	Follows          float64 `json:"follows"`
+	FollowsOfFollows float64 `json:"followsOfFollows"`
+	ViralDampening   float64 `json:"viralDampening"`
+	ReportPenalty    float64 `json:"reportPenalty"`
+	Total            float64 `json:"total"`
+}
+
+func (b ScoreBreakdown) sum() float64 {
+	return b.Comments + b.DirectReplies + b.Reactions + b.EmojiReactions + b.Dislikes +
+		b.Zaps + b.ZapAmount + b.Reposts + b.Recency + b.AuthorAffinity + b.Follows +
+		b.FollowsOfFollows + b.ViralDampening + b.ReportPenalty
+}
+
+// FeedExplanation is a note from the user's feed and why it ranked where it did
+type FeedExplanation struct {
+	NoteID    string          `json:"noteId"`
+	Author    string          `json:"author"`
+	Kind      int             `json:"kind"`
+	Content   string          `json:"content"`
+	CreatedAt nostr.Timestamp `json:"createdAt"`
+	Feed      string          `json:"feed,omitempty"` // Named feed the note was ranked in, "" for the main feed
+	Kinds     []int           `json:"kinds"`          // Kind set of the feed the note was ranked in
+	Position  int             `json:"position"`       // Place in that feed, from 1
+	Breakdown ScoreBreakdown  `json:"breakdown"`
+}
+
+// handleFeedExplainAPI explains the caller's cached feeds. With an id it
+// returns the breakdown of that note, otherwise the notes most recently served.
+func handleFeedExplainAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	explanations := explainFeed(authedPubkey(r), id)
+	if id != "" && len(explanations) == 0 {
+		http.Error(w, "Note isn't in your current feed", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(explanations); err != nil {
+		http.Error(w, "Error encoding response: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// explainFeed looks a note up in every cached feed of the user, or lists the
+// notes served from each feed's current snapshot when noteID is empty
+func explainFeed(userID, noteID string) []FeedExplanation {
+	feedPageMutex.Lock()
+	defer feedPageMutex.Unlock()
+
+	explanations := []FeedExplanation{}
+	userFeedCache.Range(func(key, value any) bool {
+		feed, kinds, ok := parseCacheKey(userID, key.(string))
+		if !ok {
+			return true
+		}
+		cachedFeeds := value.(CachedFeeds)
+		explain := func(note FeedNote, position int) {
+			explanation := newFeedExplanation(note, kinds, position)
+			explanation.Feed = feed
+			explanations = append(explanations, explanation)
+		}
+
+		if noteID != "" {
+			for _, variant := range cachedFeeds.Feeds {
+				for position, note := range variant {
+					if note.Event.ID == noteID {
+						explain(note, position)
+						return false
+					}
+				}
+			}
+			return true
+		}
+
+		snapshot := cachedFeeds.Snapshot
+		if snapshot == nil || snapshot.VariantIndex >= len(cachedFeeds.Feeds) {
+			return true
+		}
+		variant := cachedFeeds.Feeds[snapshot.VariantIndex]
+		for position := 0; position < snapshot.Cursor && position < len(variant); position++ {
+			if snapshot.Served[variant[position].Event.ID] {
+				explain(variant[position], position)
+			}
+		}
+		return true
+	})
+	return explanations
+}
+
+func newFeedExplanation(note FeedNote, kinds []int, position int) FeedExplanation {
+	content := note.Event.Content
+	if utf8.RuneCountInString(content) > explainContentLength {
+		content = string([]rune(content)[:explainContentLength]) + "…"
+	}
+	return FeedExplanation{
+		NoteID:    note.Event.ID,
+		Author:    note.Event.PubKey,
+		Kind:      note.Event.Kind,
+		Content:   content,
+		CreatedAt: note.Event.CreatedAt,
+		Kinds:     kinds,
+		Position:  position + 1,
+		Breakdown: note.Breakdown,
+	}
+}
+
+// parseCacheKey reads the feed name and kind set back out of one of the
+// user's feed cache keys
+func parseCacheKey(userID, key string) (feed string, kinds []int, ok bool) {
+	rest, ok := strings.CutPrefix(key, userID+"_")
+	if !ok {
+		return "", nil, false
+	}
+	if named, isNamed := strings.CutPrefix(rest, "feed_"); isNamed {
+		feed, rest, ok = strings.Cut(named, "_")
+		if !ok {
+			return "", nil, false
+		}
+	}
+	kindList, ok := strings.CutPrefix(rest, "kinds_")
+	if !ok {
+		return "", nil, false
+	}
+	return feed, parseKindList(kindList), true
+}
+
+// parseKindList reads a comma separated kind set
+func parseKindList(kinds string) []int {
+	var parsed []int
+	for _, value := range strings.Split(kinds, ",") {
+		if kind, err := strconv.Atoi(value); err == nil {
+			parsed = append(parsed, kind)
+		}
+	}
+	return parsed
+}
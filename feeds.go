@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const maxFeedProfiles = 20 // Named feeds a user can have
+
+// Feed names end up in cache keys and relay paths, so they are kept simple
+var feedNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+var (
+	errTooManyFeedProfiles = fmt.Errorf("you can have up to %d feeds", maxFeedProfiles)
+	errFeedProfileNotFound = errors.New("no such feed")
+)
+
+// FeedProfile is a named feed with its own weights, like "close-friends" or
+// "long-form". Kinds are served when the client's filter doesn't name any.
+type FeedProfile struct {
+	Name     string       `json:"name"`
+	Kinds    []int        `json:"kinds"`
+	Settings UserSettings `json:"settings"`
+}
+
+// feedRelays holds a relay for each /feed/<name> path that has been connected to
+var feedRelays = struct {
+	sync.Mutex
+	relays map[string]*khatru.Relay
+}{relays: make(map[string]*khatru.Relay)}
+
+func isValidFeedName(name string) bool {
+	return feedNamePattern.MatchString(name)
+}
+
+// routeFeedRelays serves connections to /feed/<name> from a relay that defaults
+// to that named feed and everything else from the main relay. Each feed relay
+// has its own service URL, so NIP-42 AUTH events name the path they were made for.
+func routeFeedRelays(mainRelay *khatru.Relay) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := strings.CutPrefix(r.URL.Path, "/feed/")
+		if !ok {
+			mainRelay.ServeHTTP(w, r)
+			return
+		}
+
+		name = strings.TrimSuffix(name, "/")
+		relay, err := getFeedRelay(r, name)
+		if err != nil {
+			http.Error(w, "Error loading feed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if relay == nil {
+			http.NotFound(w, r)
+			return
+		}
+		relay.ServeHTTP(w, r)
+	})
+}
+
+// getFeedRelay returns the relay for a feed name, creating it the first time.
+// Only names some user has a feed for get one, so the set stays bounded.
+func getFeedRelay(r *http.Request, name string) (*khatru.Relay, error) {
+	if !isValidFeedName(name) {
+		return nil, nil
+	}
+
+	feedRelays.Lock()
+	defer feedRelays.Unlock()
+
+	if relay, ok := feedRelays.relays[name]; ok {
+		return relay, nil
+	}
+
+	exists, err := repository.FeedProfileNameExists(name)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	log.Printf("Starting relay for feed: %s", name)
+	relay := newFeedRelay(name)
+	relay.ServiceURL = serviceBaseURL(r) + "/feed/" + name
+	feedRelays.relays[name] = relay
+	return relay, nil
+}
+
+// serviceBaseURL works out the relay's public URL the way khatru does for the
+// main relay
+func serviceBaseURL(r *http.Request) string {
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		if _, err := strconv.Atoi(strings.ReplaceAll(host, ".", "")); err == nil ||
+			host == "localhost" || strings.Contains(host, ":") {
+			proto = "http"
+		} else {
+			proto = "https"
+		}
+	}
+	return proto + "://" + host
+}
+
+// filterFeed returns the named feed a filter asks for: the one in its #f tag,
+// or else the one the relay serves by default
+func filterFeed(profile string, filter nostr.Filter) string {
+	if names := filter.Tags["f"]; len(names) > 0 {
+		return names[0]
+	}
+	return profile
+}
+
+// rejectUnknownFeed refuses filters for a named feed the user doesn't have, so
+// the client is told why instead of getting an empty feed
+func rejectUnknownFeed(profile string) func(context.Context, nostr.Filter) (bool, string) {
+	return func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		feed := filterFeed(profile, filter)
+		if feed == "" {
+			return false, ""
+		}
+		if _, err := repository.GetFeedProfile(khatru.GetAuthed(ctx), feed); err != nil {
+			if errors.Is(err, errFeedProfileNotFound) {
+				return true, "invalid: " + err.Error()
+			}
+			return true, "error: " + err.Error()
+		}
+		return false, ""
+	}
+}
+
+// feedRelayInfoName names a feed relay in its NIP-11 document
+func feedRelayInfoName(profile string) string {
+	name := os.Getenv("RELAY_NAME")
+	if profile == "" {
+		return name
+	}
+	return fmt.Sprintf("%s (%s)", name, profile)
+}
+
+// handleFeedProfilesAPI lists the caller's named feeds, saves one (POST) or
+// deletes one (DELETE with a name query parameter)
+func handleFeedProfilesAPI(w http.ResponseWriter, r *http.Request) {
+	pubkey := authedPubkey(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		profiles, err := repository.GetFeedProfiles(pubkey)
+		if err != nil {
+			http.Error(w, "Error retrieving feeds: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(profiles); err != nil {
+			http.Error(w, "Error encoding response: "+err.Error(), http.StatusInternalServerError)
+		}
+
+	case http.MethodPost:
+		var profile FeedProfile
+		if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+			http.Error(w, "Invalid request format: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		profile.Settings.PubKey = pubkey
+		if err := validateFeedProfile(profile); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := repository.SaveFeedProfile(pubkey, profile); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errTooManyFeedProfiles) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, "Error saving feed: "+err.Error(), status)
+			return
+		}
+		invalidateFeedProfileCache(pubkey, profile.Name)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		if !isValidFeedName(name) {
+			http.Error(w, "Invalid feed name", http.StatusBadRequest)
+			return
+		}
+		if err := repository.DeleteFeedProfile(pubkey, name); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errFeedProfileNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, "Error deleting feed: "+err.Error(), status)
+			return
+		}
+		invalidateFeedProfileCache(pubkey, name)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func validateFeedProfile(profile FeedProfile) error {
+	if !isValidFeedName(profile.Name) {
+		return fmt.Errorf("feed names are 1 to 32 lowercase letters, digits or dashes")
+	}
+	for _, kind := range profile.Kinds {
+		if kind < 0 || kind > 65535 {
+			return fmt.Errorf("invalid kind %d", kind)
+		}
+	}
+	return validateSettings(profile.Settings)
+}
+
+func (r *NostrRepository) GetFeedProfiles(pubkey string) ([]FeedProfile, error) {
+	query := `SELECT name, kinds, settings FROM feed_profiles WHERE pubkey = $1 ORDER BY name`
+	rows, err := r.db.QueryContext(context.Background(), query, pubkey)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching feed profiles: %v", err)
+	}
+	defer rows.Close()
+
+	profiles := []FeedProfile{}
+	for rows.Next() {
+		profile, err := scanFeedProfile(pubkey, rows)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, rows.Err()
+}
+
+// GetFeedProfile returns one of the user's named feeds
+func (r *NostrRepository) GetFeedProfile(pubkey, name string) (FeedProfile, error) {
+	query := `SELECT name, kinds, settings FROM feed_profiles WHERE pubkey = $1 AND name = $2`
+	profile, err := scanFeedProfile(pubkey, r.db.QueryRowContext(context.Background(), query, pubkey, name))
+	if err == sql.ErrNoRows {
+		return FeedProfile{}, fmt.Errorf("%w named %q", errFeedProfileNotFound, name)
+	}
+	return profile, err
+}
+
+// scanFeedProfile reads a feed profile row. Settings are unmarshaled on top of
+// the defaults, like the user's main settings.
+func scanFeedProfile(pubkey string, row interface{ Scan(...any) error }) (FeedProfile, error) {
+	var profile FeedProfile
+	var kinds []int64
+	var settingsJSON []byte
+	if err := row.Scan(&profile.Name, pq.Array(&kinds), &settingsJSON); err != nil {
+		if err == sql.ErrNoRows {
+			return FeedProfile{}, err
+		}
+		return FeedProfile{}, fmt.Errorf("error scanning feed profile: %v", err)
+	}
+
+	profile.Kinds = make([]int, len(kinds))
+	for i, kind := range kinds {
+		profile.Kinds[i] = int(kind)
+	}
+	profile.Settings = defaultUserSettings(pubkey)
+	if err := json.Unmarshal(settingsJSON, &profile.Settings); err != nil {
+		return FeedProfile{}, fmt.Errorf("error unmarshaling feed settings: %v", err)
+	}
+	profile.Settings.PubKey = pubkey
+	return profile, nil
+}
+
+// SaveFeedProfile creates or updates a named feed, up to maxFeedProfiles per user
+func (r *NostrRepository) SaveFeedProfile(pubkey string, profile FeedProfile) error {
+	settingsJSON, err := json.Marshal(profile.Settings)
+	if err != nil {
+		return fmt.Errorf("error marshaling settings: %v", err)
+	}
+
+	query := `
+		INSERT INTO feed_profiles (pubkey, name, kinds, settings)
+		SELECT $1, $2, $3, $4
+		WHERE EXISTS (SELECT 1 FROM feed_profiles WHERE pubkey = $1 AND name = $2)
+			OR (SELECT COUNT(*) FROM feed_profiles WHERE pubkey = $1) < $5
+		ON CONFLICT (pubkey, name) DO UPDATE SET
+			kinds = EXCLUDED.kinds,
+			settings = EXCLUDED.settings,
+			updated_at = NOW()
+	`
+	kinds := profile.Kinds
+	if kinds == nil {
+		kinds = []int{} // A nil slice would be stored as NULL
+	}
+	result, err := r.db.ExecContext(context.Background(), query, pubkey, profile.Name,
+		pq.Array(kinds), settingsJSON, maxFeedProfiles)
+	if err != nil {
+		return fmt.Errorf("error saving feed profile: %v", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errTooManyFeedProfiles
+	}
+	return nil
+}
+
+func (r *NostrRepository) DeleteFeedProfile(pubkey, name string) error {
+	query := `DELETE FROM feed_profiles WHERE pubkey = $1 AND name = $2`
+	result, err := r.db.ExecContext(context.Background(), query, pubkey, name)
+	if err != nil {
+		return fmt.Errorf("error deleting feed profile: %v", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return fmt.Errorf("%w named %q", errFeedProfileNotFound, name)
+	}
+	return nil
+}
+
+// FeedProfileNameExists reports whether any user has a feed with the name
+func (r *NostrRepository) FeedProfileNameExists(name string) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS (SELECT 1 FROM feed_profiles WHERE name = $1)`
+	if err := r.db.QueryRowContext(context.Background(), query, name).Scan(&exists); err != nil {
+		return false, fmt.Errorf("error checking feed name: %v", err)
+	}
+	return exists, nil
+}
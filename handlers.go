@@ -6,8 +6,6 @@ import (
 	"html/template"
 	"net/http"
 	"time"
-
-	"github.com/nbd-wtf/go-nostr"
 )
 
 func handleHomePage(w http.ResponseWriter, r *http.Request) {
@@ -36,14 +34,7 @@ func handleDashboardPage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handleTopAuthorsAPI(w http.ResponseWriter, r *http.Request) {
-	// Get the user's pubkey from the request
-	pubkey := r.URL.Query().Get("pubkey")
-	if pubkey == "" {
-		http.Error(w, "Missing pubkey parameter", http.StatusBadRequest)
-		return
-	}
-
+func handleTopAuthorsAPI(w http.ResponseWriter, r *http.Request, pubkey string) {
 	// Fetch top interacted authors
 	authors, err := repository.fetchTopInteractedAuthors(pubkey)
 	if err != nil {
@@ -66,23 +57,16 @@ func handleTopAuthorsAPI(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// NostrAuthRequest represents the signed event sent for authentication
-type NostrAuthRequest struct {
-	ID        string     `json:"id"`
-	PubKey    string     `json:"pubkey"`
-	CreatedAt int64      `json:"created_at"`
-	Kind      int        `json:"kind"`
-	Tags      [][]string `json:"tags"`
-	Content   string     `json:"content"`
-	Sig       string     `json:"sig"`
-}
-
 // AuthResponse represents the response sent back after authentication
 type AuthResponse struct {
-	Success bool   `json:"success"`
-	Error   string `json:"error,omitempty"`
+	Success   bool       `json:"success"`
+	Error     string     `json:"error,omitempty"`
+	Token     string     `json:"token,omitempty"` // Bearer token for clients that don't keep cookies
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
 }
 
+// handleAuth signs a user in with a NIP-98 signed request and starts a
+// session, returned both as a cookie and as a bearer token
 func handleAuth(w http.ResponseWriter, r *http.Request) {
 	// Only accept POST requests
 	if r.Method != http.MethodPost {
@@ -90,61 +74,31 @@ func handleAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse the request body
-	var authRequest NostrAuthRequest
-	if err := json.NewDecoder(r.Body).Decode(&authRequest); err != nil {
-		sendAuthResponse(w, false, "Invalid request format: "+err.Error())
+	pubkey, err := verifyNIP98(r)
+	if err != nil {
+		sendAuthResponse(w, AuthResponse{Error: err.Error()})
 		return
 	}
 
-	// Create a nostr.Event from the request data
-	nostrTags := nostr.Tags{}
-	for _, tag := range authRequest.Tags {
-		nostrTags = append(nostrTags, nostr.Tag(tag))
-	}
-
-	event := &nostr.Event{
-		ID:        authRequest.ID,
-		PubKey:    authRequest.PubKey,
-		CreatedAt: nostr.Timestamp(authRequest.CreatedAt),
-		Kind:      authRequest.Kind,
-		Tags:      nostrTags,
-		Content:   authRequest.Content,
-		Sig:       authRequest.Sig,
-	}
-
-	// Verify the signature
-	ok, err := event.CheckSignature()
+	session, err := repository.CreateSession(pubkey)
 	if err != nil {
-		sendAuthResponse(w, false, "Error verifying signature: "+err.Error())
-		return
-	}
-	if !ok {
-		sendAuthResponse(w, false, "Invalid signature")
+		http.Error(w, "Error creating session: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	setSessionCookie(w, session)
 
-	// Check if the event is recent (within the last 5 minutes)
-	eventTime := time.Unix(authRequest.CreatedAt, 0)
-	if time.Since(eventTime) > 5*time.Minute {
-		sendAuthResponse(w, false, "Authentication event is too old")
-		return
-	}
+	// Import the user's own history the first time they sign in
+	enqueueOnboarding(pubkey)
 
 	// Authentication successful
-	sendAuthResponse(w, true, "")
+	sendAuthResponse(w, AuthResponse{Success: true, Token: session.Token, ExpiresAt: &session.ExpiresAt})
 }
 
-func sendAuthResponse(w http.ResponseWriter, success bool, errorMsg string) {
+func sendAuthResponse(w http.ResponseWriter, response AuthResponse) {
 	w.Header().Set("Content-Type", "application/json")
 
-	response := AuthResponse{
-		Success: success,
-		Error:   errorMsg,
-	}
-
 	// Set appropriate status code
-	if !success {
+	if !response.Success {
 		w.WriteHeader(http.StatusUnauthorized)
 	}
 
@@ -154,111 +108,71 @@ func sendAuthResponse(w http.ResponseWriter, success bool, errorMsg string) {
 	}
 }
 
-// SettingsRequest represents the combined settings and signed event
+// SettingsRequest is the body of a settings update
 type SettingsRequest struct {
-	Settings    UserSettings     `json:"settings"`
-	SignedEvent NostrAuthRequest `json:"signedEvent"`
+	Settings UserSettings `json:"settings"`
 }
 
-// handleUserSettings handles saving and retrieving user algorithm settings
+// handleUserSettings handles saving and retrieving user algorithm settings.
+// Only the signed-in owner can save them.
 func handleUserSettings(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
 	switch r.Method {
 	case http.MethodGet:
-		// Get user settings
-		pubkey := r.URL.Query().Get("pubkey")
-		if pubkey == "" {
-			http.Error(w, "Missing pubkey parameter", http.StatusBadRequest)
-			return
-		}
-
-		settings, err := repository.GetUserSettings(pubkey)
-		if err != nil {
-			http.Error(w, "Error retrieving settings: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		if err := json.NewEncoder(w).Encode(settings); err != nil {
-			http.Error(w, "Error encoding response: "+err.Error(), http.StatusInternalServerError)
-		}
-
+		requireReadAuth(getUserSettings)(w, r)
 	case http.MethodPost:
-		// Save user settings
-		var settingsReq SettingsRequest
-		if err := json.NewDecoder(r.Body).Decode(&settingsReq); err != nil {
-			http.Error(w, "Invalid request format: "+err.Error(), http.StatusBadRequest)
-			return
-		}
-
-		// Validate pubkey
-		if settingsReq.Settings.PubKey == "" {
-			http.Error(w, "Missing pubkey in settings", http.StatusBadRequest)
-			return
-		}
-
-		// Verify the signature of the event
-		nostrTags := nostr.Tags{}
-		for _, tag := range settingsReq.SignedEvent.Tags {
-			nostrTags = append(nostrTags, nostr.Tag(tag))
-		}
-
-		event := &nostr.Event{
-			ID:        settingsReq.SignedEvent.ID,
-			PubKey:    settingsReq.SignedEvent.PubKey,
-			CreatedAt: nostr.Timestamp(settingsReq.SignedEvent.CreatedAt),
-			Kind:      settingsReq.SignedEvent.Kind,
-			Tags:      nostrTags,
-			Content:   settingsReq.SignedEvent.Content,
-			Sig:       settingsReq.SignedEvent.Sig,
-		}
+		requireAuth(saveUserSettings)(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
 
-		// Verify the signature
-		ok, err := event.CheckSignature()
-		if err != nil {
-			http.Error(w, "Error verifying signature: "+err.Error(), http.StatusUnauthorized)
-			return
-		}
-		if !ok {
-			http.Error(w, "Invalid signature", http.StatusUnauthorized)
-			return
-		}
+func getUserSettings(w http.ResponseWriter, r *http.Request, pubkey string) {
+	settings, err := repository.GetUserSettings(pubkey)
+	if err != nil {
+		http.Error(w, "Error retrieving settings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		// Check if the pubkey in the event matches the pubkey in the settings
-		if event.PubKey != settingsReq.Settings.PubKey {
-			http.Error(w, "Pubkey mismatch between signed event and settings", http.StatusUnauthorized)
-			return
-		}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(settings); err != nil {
+		http.Error(w, "Error encoding response: "+err.Error(), http.StatusInternalServerError)
+	}
+}
 
-		// Check if the event is recent (within the last 5 minutes)
-		eventTime := time.Unix(settingsReq.SignedEvent.CreatedAt, 0)
-		if time.Since(eventTime) > 5*time.Minute {
-			http.Error(w, "Authentication event is too old", http.StatusUnauthorized)
-			return
-		}
+func saveUserSettings(w http.ResponseWriter, r *http.Request) {
+	var settingsReq SettingsRequest
+	if err := json.NewDecoder(r.Body).Decode(&settingsReq); err != nil {
+		http.Error(w, "Invalid request format: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		// Validate settings values
-		if err := validateSettings(settingsReq.Settings); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+	// Users can only change their own settings
+	if settingsReq.Settings.PubKey == "" {
+		settingsReq.Settings.PubKey = authedPubkey(r)
+	}
+	if authedPubkey(r) != settingsReq.Settings.PubKey {
+		http.Error(w, "Pubkey mismatch between session and settings", http.StatusUnauthorized)
+		return
+	}
 
-		// Save settings
-		if err := repository.SaveUserSettings(settingsReq.Settings); err != nil {
-			http.Error(w, "Error saving settings: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
+	// Validate settings values
+	if err := validateSettings(settingsReq.Settings); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		// Invalidate the user's feed cache
-		invalidateUserFeedCache(settingsReq.Settings.PubKey)
+	// Save settings
+	if err := repository.SaveUserSettings(settingsReq.Settings); err != nil {
+		http.Error(w, "Error saving settings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		// Return success response
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]bool{"success": true})
+	// Invalidate the user's feed cache
+	invalidateUserFeedCache(settingsReq.Settings.PubKey)
 
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-	}
+	// Return success response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
 }
 
 // validateSettings performs basic validation on user settings
@@ -266,12 +180,20 @@ func validateSettings(settings UserSettings) error {
 	// Check for negative values
 	if settings.AuthorInteractions < 0 ||
 		settings.GlobalComments < 0 ||
+		settings.GlobalDirectReplies < 0 ||
 		settings.GlobalReactions < 0 ||
+		settings.GlobalEmojiReactions < 0 ||
+		settings.GlobalDislikes < 0 ||
 		settings.GlobalZaps < 0 ||
+		settings.GlobalReposts < 0 ||
 		settings.Recency < 0 ||
 		settings.DecayRate < 0 ||
 		settings.ViralThreshold < 0 ||
-		settings.ViralDampening < 0 {
+		settings.ViralDampening < 0 ||
+		settings.Follows < 0 ||
+		settings.FollowsOfFollows < 0 ||
+		settings.ReportPenalty < 0 ||
+		settings.GlobalZapAmount < 0 {
 		return fmt.Errorf("settings values cannot be negative")
 	}
 
@@ -285,18 +207,26 @@ func validateSettings(settings UserSettings) error {
 		return fmt.Errorf("viral dampening must be between 0 and 1")
 	}
 
+	if !isValidZapCurve(settings.ZapCurve) {
+		return fmt.Errorf("zap curve must be one of log, sqrt or linear")
+	}
+
+	if !isValidRepliesSetting(settings.Replies) {
+		return fmt.Errorf("replies must be one of off, follows or all")
+	}
+
+	// Kind quotas are shares of the feed
+	for kind, quota := range settings.KindQuotas {
+		if quota < 0 || quota > 1 {
+			return fmt.Errorf("quota for kind %d must be between 0 and 1", kind)
+		}
+	}
+
 	return nil
 }
 
 // handleUserMetricsAPI handles requests for user metrics
-func handleUserMetricsAPI(w http.ResponseWriter, r *http.Request) {
-	// Get the user's pubkey from the request
-	pubkey := r.URL.Query().Get("pubkey")
-	if pubkey == "" {
-		http.Error(w, "Missing pubkey parameter", http.StatusBadRequest)
-		return
-	}
-
+func handleUserMetricsAPI(w http.ResponseWriter, r *http.Request, pubkey string) {
 	// Fetch user metrics
 	metrics, err := repository.GetUserMetrics(pubkey)
 	if err != nil {
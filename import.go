@@ -2,7 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/nbd-wtf/go-nostr"
@@ -10,37 +19,335 @@ import (
 
 const layout = "2006-01-02"
 
-func importNotes(kind int) {
-	ctx := context.Background()
-	startDate := time.Now().Add(-3 * 24 * time.Hour)
-	startTime, _ := time.Parse(layout, startDate.Format(layout))
-	endTime := startTime.Add(24 * time.Hour)
+const (
+	importRelayConcurrency = 4
+	minImportWindow        = time.Minute // Windows aren't split any further than this
+)
 
-	for {
-		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
-		defer cancel()
+// defaultImportKinds are imported when --kinds isn't given
+var defaultImportKinds = []int{
+	nostr.KindArticle,
+	20, // KindImage
+	nostr.KindTextNote,
+	nostr.KindReaction,
+	nostr.KindRepost,
+	nostr.KindGenericRepost,
+	nostr.KindZap,
+	5, // KindDeletion
+}
+
+// ImportOptions describes a historical import
+type ImportOptions struct {
+	Since   time.Time
+	Until   time.Time // Zero means up to now
+	Kinds   []int
+	Authors []string
+	Relays  []string
+	Window  time.Duration
+	Limit   int           // Events requested per window; a full window is split in two
+	Timeout time.Duration // How long to wait for a relay to answer a window
+}
+
+// defaultImportOptions imports the last 3 days from the configured relays
+func defaultImportOptions() (ImportOptions, error) {
+	relays, err := loadRelayConfig()
+	if err != nil {
+		return ImportOptions{}, err
+	}
+	since, _ := time.Parse(layout, time.Now().AddDate(0, 0, -3).Format(layout))
+	return ImportOptions{
+		Since:   since,
+		Kinds:   defaultImportKinds,
+		Relays:  relays,
+		Window:  24 * time.Hour,
+		Limit:   500,
+		Timeout: 10 * time.Second,
+	}, nil
+}
+
+// parseImportFlags parses the arguments of the import subcommand
+func parseImportFlags(args []string) (ImportOptions, error) {
+	opts, err := defaultImportOptions()
+	if err != nil {
+		return ImportOptions{}, err
+	}
 
-		startTimestamp := nostr.Timestamp(startTime.Unix())
-		endTimestamp := nostr.Timestamp(endTime.Unix())
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	since := flags.String("since", opts.Since.Format(layout), "Import events created after this date (YYYY-MM-DD or RFC 3339)")
+	until := flags.String("until", "", "Import events created before this date (YYYY-MM-DD or RFC 3339), defaults to now")
+	kinds := flags.String("kinds", "", "Comma separated event kinds, defaults to notes, articles, images, reactions, reposts, zaps and deletions")
+	authors := flags.String("authors", "", "Comma separated hex pubkeys to import events from, defaults to everyone")
+	relays := flags.String("relays", "", "Comma separated relay URLs, defaults to the configured upstream relays")
+	flags.DurationVar(&opts.Window, "window", opts.Window, "Time range requested from a relay at once")
+	flags.IntVar(&opts.Limit, "limit", opts.Limit, "Events requested per window, windows returning this many are split")
+	flags.DurationVar(&opts.Timeout, "timeout", opts.Timeout, "How long to wait for a relay to answer a window")
+	if err := flags.Parse(args); err != nil {
+		return ImportOptions{}, err
+	}
 
-		filters := []nostr.Filter{{
-			Kinds: []int{kind},
-			Since: &startTimestamp,
-			Until: &endTimestamp,
-		}}
+	if opts.Since, err = parseImportDate(*since); err != nil {
+		return ImportOptions{}, fmt.Errorf("invalid --since: %v", err)
+	}
+	if *until != "" {
+		if opts.Until, err = parseImportDate(*until); err != nil {
+			return ImportOptions{}, fmt.Errorf("invalid --until: %v", err)
+		}
+	}
 
-		for ev := range pool.SubManyEose(ctx, relays, filters) {
-			repository.SaveNostrEvent(ev.Event)
+	if *kinds != "" {
+		opts.Kinds = nil
+		for _, value := range strings.Split(*kinds, ",") {
+			kind, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return ImportOptions{}, fmt.Errorf("invalid kind %q", value)
+			}
+			opts.Kinds = append(opts.Kinds, kind)
 		}
+	}
 
-		startTime = startTime.Add(24 * time.Hour)
-		endTime = endTime.Add(24 * time.Hour)
+	for _, author := range strings.Split(*authors, ",") {
+		author = strings.TrimSpace(author)
+		if author == "" {
+			continue
+		}
+		if len(author) != PubkeyLength || !nostr.IsValid32ByteHex(author) {
+			return ImportOptions{}, fmt.Errorf("invalid author %q", author)
+		}
+		opts.Authors = append(opts.Authors, author)
+	}
 
-		if startTime.After(time.Now()) {
-			log.Println("✅ imported notes of kind:", kind)
-			break
+	if *relays != "" {
+		opts.Relays = nil
+		for _, url := range strings.Split(*relays, ",") {
+			if url = strings.TrimSpace(url); url != "" {
+				opts.Relays = append(opts.Relays, nostr.NormalizeURL(url))
+			}
 		}
+	}
+
+	if opts.Window < minImportWindow || opts.Limit <= 0 || opts.Timeout <= 0 {
+		return ImportOptions{}, fmt.Errorf("--window must be at least %v, --limit and --timeout positive", minImportWindow)
+	}
+	if len(opts.Relays) == 0 {
+		return ImportOptions{}, fmt.Errorf("no relays to import from")
+	}
+
+	return opts, nil
+}
+
+func parseImportDate(value string) (time.Time, error) {
+	if t, err := time.Parse(layout, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// jobKey identifies an import by what it fetches, so rerunning the same
+// import resumes from its checkpoints. Until is left out so a rerun with a
+// later end date continues where the previous run stopped.
+func (opts ImportOptions) jobKey() string {
+	kinds := make([]string, len(opts.Kinds))
+	for i, kind := range opts.Kinds {
+		kinds[i] = strconv.Itoa(kind)
+	}
+	sort.Strings(kinds)
+	authors := append([]string(nil), opts.Authors...)
+	sort.Strings(authors)
+
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%d|%s|%s",
+		opts.Since.Unix(), strings.Join(kinds, ","), strings.Join(authors, ","))))
+	return hex.EncodeToString(hash[:8])
+}
+
+// runImport fetches historical events from each relay in time windows and
+// feeds them to the ingestion pipeline
+func runImport(ctx context.Context, opts ImportOptions) error {
+	jobKey := opts.jobKey()
+	log.Printf("📦 importing kinds %v from %d relays since %s (job %s)",
+		opts.Kinds, len(opts.Relays), opts.Since.Format(time.RFC3339), jobKey)
+
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, importRelayConcurrency)
+	for _, url := range opts.Relays {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(url string) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			if err := importFromRelay(ctx, url, jobKey, opts); err != nil {
+				log.Printf("Import from %s stopped: %v", url, err)
+			}
+		}(url)
+	}
+	wg.Wait()
+
+	log.Printf("✅ import %s done", jobKey)
+	return ctx.Err()
+}
+
+func importFromRelay(ctx context.Context, url, jobKey string, opts ImportOptions) error {
+	until := opts.Until
+	if until.IsZero() {
+		until = time.Now()
+	}
+
+	start := opts.Since
+	checkpoint, err := repository.GetImportCheckpoint(jobKey, url)
+	if err != nil {
+		return err
+	}
+	if checkpoint.After(start) {
+		log.Printf("Resuming import from %s at %s", url, checkpoint.Format(time.RFC3339))
+		start = checkpoint
+	}
+
+	for start.Before(until) && ctx.Err() == nil {
+		end := start.Add(opts.Window)
+		if end.After(until) {
+			end = until
+		}
+
+		var tracker ingestTracker
+		count, err := importWindow(ctx, url, start, end, opts, &tracker)
+		log.Printf("imported %d events from %s between %s and %s", count, url, start.Format(time.RFC3339), end.Format(time.RFC3339))
+		if err != nil {
+			// Resuming the job starts again from this window
+			return fmt.Errorf("events between %s and %s weren't all fetched: %v", start.Format(time.RFC3339), end.Format(time.RFC3339), err)
+		}
+
+		// The window is only marked done once its events are saved, so an
+		// interrupted import fetches them again
+		if !tracker.wait(ctx) {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("events between %s and %s failed to save", start.Format(time.RFC3339), end.Format(time.RFC3339))
+		}
+		if err := repository.SaveImportCheckpoint(jobKey, url, end); err != nil {
+			return err
+		}
+		start = end
+	}
+	return ctx.Err()
+}
+
+// importWindow fetches the events of one window. When the relay returns as
+// many events as requested, or doesn't finish in time, it probably cut the
+// window short, so the window is split in two and each half is fetched again.
+// An error means part of the window is missing.
+func importWindow(ctx context.Context, url string, start, end time.Time, opts ImportOptions, tracker *ingestTracker) (int, error) {
+	since := nostr.Timestamp(start.Unix())
+	until := nostr.Timestamp(end.Unix())
+	filter := nostr.Filter{
+		Kinds:   opts.Kinds,
+		Authors: opts.Authors,
+		Since:   &since,
+		Until:   &until,
+		Limit:   opts.Limit,
+	}
+
+	windowCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	count := 0
+	eosed, err := fetchStoredEvents(windowCtx, url, filter, func(ev *nostr.Event) {
+		if enqueueTrackedEvent(ctx, ev, tracker) {
+			count++
+		}
+	})
+	cancel()
+	if err != nil {
+		return count, err
+	}
+	if ctx.Err() != nil {
+		return count, ctx.Err()
+	}
+
+	if eosed && count < opts.Limit {
+		return count, nil
+	}
+	if end.Sub(start) <= minImportWindow {
+		if !eosed {
+			return count, fmt.Errorf("%s didn't answer within %v", url, opts.Timeout)
+		}
+		log.Printf("Import window %s to %s on %s is still full at the smallest window size",
+			start.Format(time.RFC3339), end.Format(time.RFC3339), url)
+		return count, nil
+	}
+
+	// Events already fetched are dropped as duplicates by the pipeline
+	middle := start.Add(end.Sub(start) / 2)
+	first, err := importWindow(ctx, url, start, middle, opts, tracker)
+	if err != nil {
+		return first, err
+	}
+	second, err := importWindow(ctx, url, middle, end, opts, tracker)
+	return first + second, err
+}
+
+// fetchStoredEvents asks the relay for stored events and hands each one to
+// handle. It reports whether the relay got to EOSE before ctx ended, and
+// returns an error when the relay can't be reached, closes the subscription or
+// drops the connection.
+func fetchStoredEvents(ctx context.Context, url string, filter nostr.Filter, handle func(*nostr.Event)) (bool, error) {
+	relay, err := ingestPool.EnsureRelay(url)
+	if err != nil {
+		return false, fmt.Errorf("error connecting to %s: %v", url, err)
+	}
+	// Signatures are checked by the ingestion workers
+	relay.AssumeValid = true
+
+	sub, err := relay.Subscribe(ctx, nostr.Filters{filter})
+	if err != nil {
+		return false, fmt.Errorf("error subscribing to %s: %v", url, err)
+	}
+	defer sub.Unsub()
+
+	for {
+		select {
+		case <-sub.EndOfStoredEvents:
+			return true, nil
+		case reason := <-sub.ClosedReason:
+			return false, fmt.Errorf("%s closed the subscription: %s", url, reason)
+		case ev, more := <-sub.Events:
+			if more {
+				handle(ev)
+				continue
+			}
+		case <-sub.Context.Done():
+		}
+
+		if ctx.Err() != nil {
+			return false, nil
+		}
+		return false, fmt.Errorf("lost the connection to %s", url)
+	}
+}
+
+// GetImportCheckpoint returns how far the import has got on the relay
+func (r *NostrRepository) GetImportCheckpoint(jobKey, relayURL string) (time.Time, error) {
+	query := `SELECT completed_until FROM import_checkpoints WHERE job_key = $1 AND relay_url = $2`
+
+	var completedUntil time.Time
+	err := r.db.QueryRowContext(context.Background(), query, jobKey, relayURL).Scan(&completedUntil)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error fetching import checkpoint: %v", err)
+	}
+	return completedUntil, nil
+}
 
-		log.Println("importing notes of kind:", kind, "from", startTime.Format(layout), "to", endTime.Format(layout))
+func (r *NostrRepository) SaveImportCheckpoint(jobKey, relayURL string, completedUntil time.Time) error {
+	query := `
+        INSERT INTO import_checkpoints (job_key, relay_url, completed_until, updated_at)
+        VALUES ($1, $2, $3, NOW())
+        ON CONFLICT (job_key, relay_url) DO UPDATE SET
+            completed_until = GREATEST(import_checkpoints.completed_until, EXCLUDED.completed_until),
+            updated_at = NOW();
+    `
+	_, err := r.db.ExecContext(context.Background(), query, jobKey, relayURL, completedUntil.UTC())
+	if err != nil {
+		return fmt.Errorf("error saving import checkpoint: %v", err)
 	}
+	return nil
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	ingestQueueSize     = 10000
+	ingestBatchSize     = 500
+	ingestFlushInterval = time.Second
+	ingestStatsInterval = time.Minute
+)
+
+type ingestItem struct {
+	event   *nostr.Event
+	source  *upstreamRelay // nil for events that didn't come from a live subscription
+	tracker *ingestTracker // Set when the sender waits for the event to be saved
+}
+
+// ingestTracker lets a sender wait until the events it enqueued are saved or
+// dropped, and tells it whether any of them failed to save
+type ingestTracker struct {
+	sync.WaitGroup
+	failed atomic.Bool
+}
+
+// wait blocks until every tracked event is done, or ctx ends. It returns
+// false unless all of them were handled without a database error.
+func (t *ingestTracker) wait(ctx context.Context) bool {
+	finished := make(chan struct{})
+	go func() {
+		t.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return !t.failed.Load()
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (item ingestItem) finish(failed bool) {
+	ingestCounters.pending.Add(-1)
+	if item.tracker != nil {
+		if failed {
+			item.tracker.failed.Store(true)
+		}
+		item.tracker.Done()
+	}
+}
+
+// ingestQueue is bounded so that a slow database pushes back on the relay
+// subscriptions instead of buffering without limit
+var ingestQueue = make(chan ingestItem, ingestQueueSize)
+
+// batchQueue carries validated rows from the workers to the batch writer
+var batchQueue = make(chan *eventBatch, 64)
+
+var ingestCounters struct {
+	// Saved, or skipped by the database because the note they engage with
+	// isn't stored or they were deleted. Rows aren't counted one by one.
+	writtenOrSkipped atomic.Int64
+	invalid          atomic.Int64 // Bad IDs or signatures
+	rejected         atomic.Int64 // Malformed events
+	duplicates       atomic.Int64
+	failed           atomic.Int64 // Database errors
+	pending          atomic.Int64 // Enqueued but not yet saved or dropped
+}
+
+// IngestStats summarises the ingestion pipeline since startup
+type IngestStats struct {
+	WrittenOrSkipped int64 `json:"writtenOrSkipped"`
+	Invalid          int64 `json:"invalid"`
+	Rejected         int64 `json:"rejected"`
+	Duplicates       int64 `json:"duplicates"`
+	Failed           int64 `json:"failed"`
+	Queued           int   `json:"queued"`
+}
+
+func GetIngestStats() IngestStats {
+	return IngestStats{
+		WrittenOrSkipped: ingestCounters.writtenOrSkipped.Load(),
+		Invalid:          ingestCounters.invalid.Load(),
+		Rejected:         ingestCounters.rejected.Load(),
+		Duplicates:       ingestCounters.duplicates.Load(),
+		Failed:           ingestCounters.failed.Load(),
+		Queued:           len(ingestQueue),
+	}
+}
+
+// startIngestion starts the workers that validate queued events, one per
+// core since signature checks are CPU bound, and the writer that saves them
+// in batches
+func startIngestion(ctx context.Context) {
+	for i := 0; i < runtime.NumCPU(); i++ {
+		go ingestWorker(ctx)
+	}
+	go batchWriter(ctx)
+	go logIngestStats(ctx)
+}
+
+// enqueueEvent hands an event to the pipeline, blocking while the queue is full
+func enqueueEvent(ctx context.Context, event *nostr.Event, source *upstreamRelay) bool {
+	return enqueueItem(ctx, ingestItem{event: event, source: source})
+}
+
+// enqueueTrackedEvent is enqueueEvent for senders that wait on the tracker
+// until their events are saved
+func enqueueTrackedEvent(ctx context.Context, event *nostr.Event, tracker *ingestTracker) bool {
+	tracker.Add(1)
+	if !enqueueItem(ctx, ingestItem{event: event, tracker: tracker}) {
+		tracker.Done()
+		return false
+	}
+	return true
+}
+
+func enqueueItem(ctx context.Context, item ingestItem) bool {
+	// Counted before sending so a worker can't finish the item first
+	ingestCounters.pending.Add(1)
+	select {
+	case ingestQueue <- item:
+		return true
+	case <-ctx.Done():
+		ingestCounters.pending.Add(-1)
+		return false
+	}
+}
+
+func ingestWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case item := <-ingestQueue:
+			ingestEvent(ctx, item)
+		}
+	}
+}
+
+func ingestEvent(ctx context.Context, item ingestItem) {
+	event := item.event
+
+	if !verifyEvent(event) {
+		ingestCounters.invalid.Add(1)
+		item.finish(false)
+		item.source.recordInvalid()
+		return
+	}
+
+	// Only mark the event as seen once it is known to be genuine, so a forged
+	// copy can't shadow the real one
+	if !markEventSeen(event.ID) {
+		ingestCounters.duplicates.Add(1)
+		item.finish(false)
+		item.source.recordDuplicate()
+		return
+	}
+
+	if !isBatchedKind(event.Kind) {
+		err := repository.SaveNostrEvent(event)
+		if err != nil {
+			ingestCounters.failed.Add(1)
+		} else {
+			ingestCounters.writtenOrSkipped.Add(1)
+		}
+		item.finish(err != nil)
+		return
+	}
+
+	batch := &eventBatch{}
+	if item.tracker != nil {
+		batch.trackers = append(batch.trackers, item.tracker)
+	}
+	if err := repository.addToBatch(event, batch); err != nil {
+		ingestCounters.rejected.Add(1)
+		item.finish(false)
+		item.source.recordRejected()
+		return
+	}
+	select {
+	case batchQueue <- batch:
+	case <-ctx.Done():
+		// The writer stops with the same context, the event is dropped
+		item.finish(true)
+	}
+}
+
+// verifyEvent checks that the event ID is the hash of its content and that the
+// signature matches the author
+func verifyEvent(event *nostr.Event) bool {
+	if !event.CheckID() {
+		return false
+	}
+	ok, err := event.CheckSignature()
+	return err == nil && ok
+}
+
+// waitForIngestion blocks until every enqueued event has been saved or dropped
+func waitForIngestion() {
+	for ingestCounters.pending.Load() > 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// batchWriter merges rows from the workers and writes them when the batch is
+// full or the flush interval passes
+func batchWriter(ctx context.Context) {
+	ticker := time.NewTicker(ingestFlushInterval)
+	defer ticker.Stop()
+
+	pending := &eventBatch{}
+	flush := func() {
+		if pending.size() == 0 {
+			return
+		}
+		defer ingestCounters.pending.Add(-int64(pending.size()))
+		failed := false
+		defer func(batch *eventBatch) { batch.finish(failed) }(pending)
+		if err := repository.insertBatch(ctx, pending); err != nil {
+			log.Printf("Error writing batch of %d events, retrying one by one: %v", pending.size(), err)
+			// Retry row by row so one bad row doesn't lose the whole batch
+			for _, single := range pending.split() {
+				if err := repository.insertBatch(ctx, single); err != nil {
+					ingestCounters.failed.Add(1)
+					failed = true
+				} else {
+					ingestCounters.writtenOrSkipped.Add(1)
+				}
+			}
+		} else {
+			ingestCounters.writtenOrSkipped.Add(int64(pending.size()))
+		}
+		pending = &eventBatch{}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return
+		case <-ticker.C:
+			flush()
+		case batch := <-batchQueue:
+			pending.merge(batch)
+			if pending.size() >= ingestBatchSize {
+				flush()
+			}
+		}
+	}
+}
+
+func logIngestStats(ctx context.Context) {
+	ticker := time.NewTicker(ingestStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stats := GetIngestStats()
+			log.Printf("Ingested %d events, written or skipped (%d invalid, %d rejected, %d duplicates, %d failed, %d queued)",
+				stats.WrittenOrSkipped, stats.Invalid, stats.Rejected, stats.Duplicates, stats.Failed, stats.Queued)
+		}
+	}
+}
+
+// handleAdminIngest reports the ingestion pipeline counters. It requires the
+// ADMIN_API_KEY as a bearer token.
+func handleAdminIngest(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(GetIngestStats()); err != nil {
+		http.Error(w, "Error encoding response: "+err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -19,46 +19,15 @@ import (
 )
 
 var ctx = context.Background()
+
+// pool checks the signature of every event it receives
 var pool = nostr.NewSimplePool(ctx)
+
+// ingestPool connects to the upstream relays. Its relays are marked AssumeValid
+// because everything read from it goes through the ingestion workers, which
+// verify events in parallel. Only read from it through enqueueEvent.
+var ingestPool = nostr.NewSimplePool(ctx)
 var repository *NostrRepository
-var relays = []string{
-	"wss://relay.lexingtonbitcoin.org",
-	"wss://nostr.600.wtf",
-	"wss://nostr.hexhex.online",
-	"wss://wot.utxo.one",
-	"wss://nostrelites.org",
-	"wss://wot.nostr.party",
-	"wss://wot.puhcho.me",
-	"wss://wot.girino.org",
-	"wss://relay.beeola.me",
-	"wss://zap.watch",
-	"wss://wot.yeghro.site",
-	"wss://wot.innovativecerebrum.ai",
-	"wss://wot.swarmstr.com",
-	"wss://wot.azzamo.net",
-	"wss://satsage.xyz",
-	"wss://wot.sandwich.farm",
-	"wss://wons.calva.dev",
-	"wss://wot.shaving.kiwi",
-	"wss://wot.tealeaf.dev",
-	"wss://wot.dtonon.com",
-	"wss://wot.relay.vanderwarker.family",
-	"wss://wot.zacoos.com",
-	"wss://nos.lol",
-	"wss://nostr.mom",
-	"wss://purplepag.es",
-	"wss://purplerelay.com",
-	"wss://relay.damus.io",
-	"wss://relay.nostr.band",
-	"wss://relay.snort.social",
-	"wss://relayable.org",
-	"wss://relay.primal.net",
-	"wss://relay.nostr.bg",
-	"wss://no.str.cr",
-	"wss://nostr21.com",
-	"wss://nostrue.com",
-	"wss://relay.siamstr.com",
-}
 
 var db *sql.DB
 var art = `
@@ -80,7 +49,7 @@ func main() {
 	reset := "\033[0m"
 	fmt.Println(green + art + reset)
 
-	importFlag := flag.Bool("import", false, "Run the importNotes function after initializing relays")
+	importFlag := flag.Bool("import", false, "Import the last 3 days of events from the upstream relays while the relay runs")
 	flag.Parse()
 	conn, err := getDBConnection()
 
@@ -92,9 +61,19 @@ func main() {
 	repository = NewNostrRepository(db)
 	weightInteractionsWithAuthor = getWeightFloat64("WEIGHT_INTERACTIONS_WITH_AUTHOR")
 	weightCommentsGlobal = getWeightFloat64("WEIGHT_COMMENTS_GLOBAL")
+	weightDirectRepliesGlobal = getWeightFloat64("WEIGHT_DIRECT_REPLIES_GLOBAL")
 	weightReactionsGlobal = getWeightFloat64("WEIGHT_REACTIONS_GLOBAL")
+	weightEmojiReactionsGlobal = getWeightFloat64("WEIGHT_EMOJI_REACTIONS_GLOBAL")
+	weightDislikesGlobal = getWeightFloat64("WEIGHT_DISLIKES_GLOBAL")
 	weightZapsGlobal = getWeightFloat64("WEIGHT_ZAPS_GLOBAL")
+	weightRepostsGlobal = getWeightFloat64("WEIGHT_REPOSTS_GLOBAL")
 	weightRecency = getWeightFloat64("WEIGHT_RECENCY")
+	weightFollows = getWeightFloat64("WEIGHT_FOLLOWS")
+	weightFollowsOfFollows = getWeightFloat64("WEIGHT_FOLLOWS_OF_FOLLOWS")
+	weightReportPenalty = getWeightFloat64("WEIGHT_REPORT_PENALTY")
+	weightZapAmountGlobal = getWeightFloat64("WEIGHT_ZAP_AMOUNT_GLOBAL")
+	zapAmountCurve = getZapCurve("ZAP_AMOUNT_CURVE")
+	feedReplies = getRepliesSetting("FEED_REPLIES")
 	viralThreshold = getWeightFloat64("VIRAL_THRESHOLD")
 	viralNoteDampening = getWeightFloat64("VIRAL_NOTE_DAMPENING")
 	decayRate = getWeightFloat64("DECAY_RATE")
@@ -109,29 +88,84 @@ func main() {
 		log.Fatalf("Invalid PURGE_MONTHS value: %v\n", err)
 	}
 
-	if *importFlag {
-		log.Println("📦 importing notes")
-		importNotes(nostr.KindArticle)
-		importNotes(20) // KindImage
-		importNotes(nostr.KindTextNote)
-		importNotes(nostr.KindReaction)
-		importNotes(nostr.KindZap)
-
-		log.Println("📦 done importing notes. Please restart relay")
+	if limit, err := strconv.Atoi(os.Getenv("INVALID_EVENT_LIMIT")); err == nil && limit > 0 {
+		invalidEventLimit = limit
+	}
+
+	startIngestion(ctx)
+
+	// `algo-relay import [flags]` imports historical events and exits
+	if flag.Arg(0) == "import" {
+		opts, err := parseImportFlags(flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("Invalid import options: %v", err)
+		}
+		if err := runImport(ctx, opts); err != nil {
+			log.Fatalf("Import failed: %v", err)
+		}
+		waitForIngestion()
 		return
 	}
 
+	if *importFlag {
+		opts, err := defaultImportOptions()
+		if err != nil {
+			log.Fatalf("Invalid import options: %v", err)
+		}
+		go runImport(ctx, opts)
+	}
+
 	go subscribeAll()
+	repository.resolveZapProviders(ctx)
+	startOnboarding(ctx)
 	go purgeData(purgeMonths)
+	go expireUsedAuthEvents(ctx)
+	if publicBaseURL() == "" {
+		log.Println("PUBLIC_URL is not set, so signing in with NIP-98 is disabled")
+	}
 
 	go func() {
 		refreshViralNotes(ctx)                // Immediate refresh when the application starts
 		go refreshViralNotesPeriodically(ctx) // Start the periodic refresh
 	}()
 
+	relay := newFeedRelay("")
+
+	log.Println("🚀 Relay started on port 3334")
+	mux := relay.Router()
+
+	mux.HandleFunc("/", handleHomePage)
+	mux.HandleFunc("/dashboard.html", handleDashboardPage)
+	mux.HandleFunc("/api/top-authors", requireReadAuth(handleTopAuthorsAPI))
+	mux.HandleFunc("/auth", handleAuth)
+	mux.HandleFunc("/auth/logout", handleLogout)
+	mux.HandleFunc("/api/settings", handleUserSettings)
+	mux.HandleFunc("/api/user-metrics", requireReadAuth(handleUserMetricsAPI))
+	mux.HandleFunc("/api/onboarding", requireReadAuth(handleOnboardingAPI))
+	mux.HandleFunc("/api/feed/explain", requireAuth(handleFeedExplainAPI))
+	mux.HandleFunc("/api/feed/preview", requireAuth(handleFeedPreviewAPI))
+	mux.HandleFunc("/api/feeds", requireAuth(handleFeedProfilesAPI))
+	mux.HandleFunc("/api/admin/relays", handleAdminRelays)
+	mux.HandleFunc("/api/admin/ingest", handleAdminIngest)
+
+	err = http.ListenAndServe(":3334", routeFeedRelays(relay))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
+	mux.HandleFunc("/", handleHomePage)
+
+	log.Printf("listening at http://0.0.0.0:3334")
+	http.ListenAndServe("0.0.0.0:3334", relay)
+}
+
+// newFeedRelay sets up a relay serving users their feed. Relays for a named
+// feed serve it unless the client picks another with a #f filter.
+func newFeedRelay(profile string) *khatru.Relay {
 	relay := khatru.NewRelay()
 	relay.Info.Description = os.Getenv("RELAY_DESCRIPTION")
-	relay.Info.Name = os.Getenv("RELAY_NAME")
+	relay.Info.Name = feedRelayInfoName(profile)
 	relay.Info.PubKey = os.Getenv("RELAY_PUBKEY")
 	relay.Info.Software = "https://github.com/bitvora/algo-relay"
 	relay.Info.Version = "0.1.1"
@@ -168,6 +202,7 @@ func main() {
 
 		return false, ""
 	})
+	relay.RejectFilter = append(relay.RejectFilter, rejectUnknownFeed(profile))
 	relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
 		return true, "you cannot publish to this relay"
 	})
@@ -180,23 +215,33 @@ func main() {
 		go func() {
 			defer close(ch)
 
+			// Clients look up the notes replies in the feed point to through
+			// their e tags, to show the thread they belong to
+			if len(copyFilter.IDs) > 0 {
+				notes, err := repository.GetNotesByIDs(ctx, copyFilter.IDs)
+				if err != nil {
+					log.Println("Error fetching notes by ID:", err)
+					return
+				}
+				for _, note := range notes {
+					ch <- note
+				}
+				return
+			}
+
 			limit := copyFilter.Limit
 			if limit == 0 {
 				limit = 50
 			}
 
-			kinds := copyFilter.Kinds
-			var kind int
-			if len(kinds) == 0 {
-				kind = nostr.KindTextNote
-			} else {
-				kind = kinds[0]
-			}
+			// A #f filter picks one of the user's named feeds over the one
+			// this relay serves by default
+			feed := filterFeed(profile, copyFilter)
 
-			events, err := GetUserFeed(ctx, authenticatedUser, limit, kind)
-			fmt.Println("getting events of kind:", kind)
+			events, err := GetUserFeed(ctx, authenticatedUser, feed, limit, copyFilter.Kinds, copyFilter.Since, copyFilter.Until)
+			fmt.Println("getting events of kinds:", copyFilter.Kinds, "feed:", feed)
 			if err != nil {
-				log.Println("Error fetching most reacted posts:", err)
+				log.Println("Error fetching feed:", err)
 				return
 			}
 
@@ -208,48 +253,15 @@ func main() {
 		return ch, nil
 	})
 
-	log.Println("🚀 Relay started on port 3334")
-	mux := relay.Router()
-
-	mux.HandleFunc("/", handleHomePage)
-	mux.HandleFunc("/dashboard.html", handleDashboardPage)
-	mux.HandleFunc("/api/top-authors", handleTopAuthorsAPI)
-	mux.HandleFunc("/auth", handleAuth)
-	mux.HandleFunc("/api/settings", handleUserSettings)
-	mux.HandleFunc("/api/user-metrics", handleUserMetricsAPI)
-
-	err = http.ListenAndServe(":3334", relay)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
-	mux.HandleFunc("/", handleHomePage)
-
-	log.Printf("listening at http://0.0.0.0:3334")
-	http.ListenAndServe("0.0.0.0:3334", relay)
+	return relay
 }
 
 func subscribeAll() {
-	now := nostr.Now()
-	filters := nostr.Filters{{
-		Kinds: []int{
-			nostr.KindTextNote,
-			nostr.KindReaction,
-			nostr.KindZap,
-			nostr.KindFollowList,
-			nostr.KindArticle,
-			20, // KindImage
-		},
-		Since: &now,
-	}}
-
-	for ev := range pool.SubMany(ctx, relays, filters) {
-		err := repository.SaveNostrEvent(ev.Event)
-		if err != nil {
-			continue
-		}
+	if err := reloadRelays(ctx); err != nil {
+		log.Fatalf("Error loading relays: %v", err)
 	}
+	go watchRelayConfig(ctx)
+	go runOutbox(ctx)
 }
 
 func loadEnv() {
@@ -282,6 +294,18 @@ func purgeData(months int) {
 			if err := repository.PurgeZapsOlderThan(months); err != nil {
 				log.Printf("Error purging zaps: %v\n", err)
 			}
+			if err := repository.PurgeRepostsOlderThan(months); err != nil {
+				log.Printf("Error purging reposts: %v\n", err)
+			}
+			if err := repository.PurgeReportsOlderThan(months); err != nil {
+				log.Printf("Error purging reports: %v\n", err)
+			}
+			if err := repository.PurgeDeletionsOlderThan(months); err != nil {
+				log.Printf("Error purging deletions: %v\n", err)
+			}
+			if err := repository.PurgeExpiredSessions(); err != nil {
+				log.Printf("Error purging sessions: %v\n", err)
+			}
 
 			log.Println("Data purge completed.")
 		}
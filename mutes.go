@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// MuteList holds the public entries of a user's NIP-51 mute list (kind 10000)
+type MuteList struct {
+	Pubkeys  map[string]bool
+	Hashtags map[string]bool
+	Words    []string
+	Threads  map[string]bool
+}
+
+// Matches reports whether the event is hidden by the mute list
+func (m MuteList) Matches(event nostr.Event) bool {
+	if m.Pubkeys[event.PubKey] || m.Threads[event.ID] {
+		return true
+	}
+
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "t":
+			if m.Hashtags[strings.ToLower(tag[1])] {
+				return true
+			}
+		case "e", "E":
+			if m.Threads[tag[1]] {
+				return true
+			}
+		}
+	}
+
+	if len(m.Words) > 0 {
+		content := strings.ToLower(event.Content)
+		for _, word := range m.Words {
+			if strings.Contains(content, word) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (r *NostrRepository) saveMuteList(event *nostr.Event) error {
+	// The columns are NOT NULL, and pq.Array stores a nil slice as NULL
+	pubkeys, hashtags, words, threads := []string{}, []string{}, []string{}, []string{}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[1] == "" {
+			continue
+		}
+		switch tag[0] {
+		case "p":
+			pubkeys = append(pubkeys, tag[1])
+		case "t":
+			hashtags = append(hashtags, strings.ToLower(tag[1]))
+		case "word":
+			words = append(words, strings.ToLower(tag[1]))
+		case "e":
+			threads = append(threads, tag[1])
+		}
+	}
+
+	// Mute lists are replaceable, only keep the newest one
+	query := `
+        INSERT INTO mute_lists (pubkey, muted_pubkeys, muted_hashtags, muted_words, muted_threads, created_at)
+        VALUES ($1, $2, $3, $4, $5, to_timestamp($6))
+        ON CONFLICT (pubkey) DO UPDATE SET
+            muted_pubkeys = EXCLUDED.muted_pubkeys,
+            muted_hashtags = EXCLUDED.muted_hashtags,
+            muted_words = EXCLUDED.muted_words,
+            muted_threads = EXCLUDED.muted_threads,
+            created_at = EXCLUDED.created_at
+        WHERE mute_lists.created_at < EXCLUDED.created_at;
+    `
+	result, err := r.db.ExecContext(context.Background(), query,
+		event.PubKey, pq.Array(pubkeys), pq.Array(hashtags), pq.Array(words), pq.Array(threads), event.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+		invalidateUserFeedCache(event.PubKey)
+	}
+	return nil
+}
+
+// GetMuteList returns the user's mute list, or an empty one if they have none
+func (r *NostrRepository) GetMuteList(pubkey string) (MuteList, error) {
+	query := `
+		SELECT muted_pubkeys, muted_hashtags, muted_words, muted_threads
+		FROM mute_lists
+		WHERE pubkey = $1
+	`
+
+	var pubkeys, hashtags, words, threads pq.StringArray
+	err := r.db.QueryRowContext(context.Background(), query, pubkey).Scan(&pubkeys, &hashtags, &words, &threads)
+	if err != nil && err != sql.ErrNoRows {
+		return MuteList{}, fmt.Errorf("error fetching mute list: %v", err)
+	}
+
+	return MuteList{
+		Pubkeys:  toSet(pubkeys),
+		Hashtags: toSet(hashtags),
+		Words:    words,
+		Threads:  toSet(threads),
+	}, nil
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// saveReport stores a NIP-56 report (kind 1984) against a note or a pubkey
+func (r *NostrRepository) saveReport(event *nostr.Event) error {
+	var reportedPubkey, noteID, reportType string
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch {
+		case tag[0] == "p" && reportedPubkey == "":
+			reportedPubkey = tag[1]
+			if len(tag) >= 3 && reportType == "" {
+				reportType = tag[2]
+			}
+		case tag[0] == "e" && noteID == "":
+			noteID = tag[1]
+			if len(tag) >= 3 {
+				reportType = tag[2]
+			}
+		}
+	}
+
+	if reportedPubkey == "" && noteID == "" {
+		return fmt.Errorf("report does not reference a pubkey or note")
+	}
+
+	query := `
+        INSERT INTO reports (id, reporter_id, reported_pubkey, note_id, report_type, created_at)
+        VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''), to_timestamp($6))
+        ON CONFLICT (id) DO NOTHING;
+    `
+	_, err := r.db.ExecContext(context.Background(), query,
+		event.ID, event.PubKey, reportedPubkey, noteID, reportType, event.CreatedAt)
+	return err
+}
+
+// fetchReportCountsFromFollows counts, per note, how many of the user's follows reported it
+func (r *NostrRepository) fetchReportCountsFromFollows(userID string, noteIDs []string) (map[string]int, error) {
+	start := time.Now()
+	query := `
+		SELECT note_id, COUNT(DISTINCT reporter_id)
+		FROM reports
+		WHERE note_id = ANY($2)
+		AND reporter_id IN (SELECT follow_id FROM follows WHERE pubkey = $1)
+		GROUP BY note_id;
+	`
+	rows, err := r.db.QueryContext(context.Background(), query, userID, pq.Array(noteIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var noteID string
+		var count int
+		if err := rows.Scan(&noteID, &count); err != nil {
+			return nil, err
+		}
+		counts[noteID] = count
+	}
+	log.Printf("Fetched report counts from follows in %v", time.Since(start))
+	return counts, rows.Err()
+}
+
+// applyReportPenalty lowers the score of notes reported by people the user
+// follows and re-sorts the notes by score
+func (r *NostrRepository) applyReportPenalty(userID string, notes []FeedNote, penalty float64) ([]FeedNote, error) {
+	if penalty <= 0 || len(notes) == 0 {
+		return notes, nil
+	}
+
+	noteIDs := make([]string, len(notes))
+	for i, note := range notes {
+		noteIDs[i] = note.Event.ID
+	}
+
+	reportCounts, err := r.fetchReportCountsFromFollows(userID, noteIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range notes {
+		notes[i].Breakdown.ReportPenalty = -float64(reportCounts[notes[i].Event.ID]) * penalty
+		notes[i].Breakdown.Total = notes[i].Breakdown.sum()
+		notes[i].Score = notes[i].Breakdown.Total
+	}
+
+	sort.Slice(notes, func(i, j int) bool {
+		return notes[i].Score > notes[j].Score
+	})
+	return notes, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestMuteListMatches(t *testing.T) {
+	// Hashtags and words are stored lowercased, as saveMuteList does
+	mutes := MuteList{
+		Pubkeys:  toSet([]string{"muted-author"}),
+		Hashtags: toSet([]string{"politics"}),
+		Words:    []string{"giveaway"},
+		Threads:  toSet([]string{"muted-thread"}),
+	}
+
+	tests := []struct {
+		name  string
+		event nostr.Event
+		want  bool
+	}{
+		{
+			name:  "muted author",
+			event: nostr.Event{PubKey: "muted-author", Content: "hello"},
+			want:  true,
+		},
+		{
+			name:  "root of a muted thread",
+			event: nostr.Event{ID: "muted-thread", PubKey: "someone"},
+			want:  true,
+		},
+		{
+			name:  "reply in a muted thread",
+			event: nostr.Event{PubKey: "someone", Tags: nostr.Tags{{"e", "muted-thread", "", "root"}}},
+			want:  true,
+		},
+		{
+			name:  "comment in a muted thread",
+			event: nostr.Event{PubKey: "someone", Tags: nostr.Tags{{"E", "muted-thread"}}},
+			want:  true,
+		},
+		{
+			name:  "muted hashtag in another case",
+			event: nostr.Event{PubKey: "someone", Tags: nostr.Tags{{"t", "Politics"}}},
+			want:  true,
+		},
+		{
+			name:  "muted word inside the content",
+			event: nostr.Event{PubKey: "someone", Content: "Huge GIVEAWAY today"},
+			want:  true,
+		},
+		{
+			name:  "tag without a value",
+			event: nostr.Event{PubKey: "someone", Tags: nostr.Tags{{"t"}, {"e"}}},
+			want:  false,
+		},
+		{
+			name: "nothing muted",
+			event: nostr.Event{ID: "other-note", PubKey: "someone", Content: "hello",
+				Tags: nostr.Tags{{"t", "nostr"}, {"e", "other-thread"}, {"p", "muted-author"}}},
+			want: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := mutes.Matches(test.event); got != test.want {
+				t.Errorf("Matches = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	if (MuteList{}).Matches(nostr.Event{PubKey: "someone", Content: "giveaway"}) {
+		t.Error("an empty mute list matched an event")
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	onboardingWorkers       = 2
+	onboardingLookback      = 90 * 24 * time.Hour
+	onboardingLimit         = 1000             // Events requested per filter
+	onboardingTimeout       = 20 * time.Second // How long to wait for the relays to answer a query
+	onboardingNoteChunk     = 200              // Referenced notes requested by ID at once
+	onboardingOutboxRelays  = 8                // Cap on the user's own write relays queried
+	onboardingRetryInterval = time.Hour        // How long a failed job waits before it is retried
+)
+
+var (
+	onboardingQueue    = make(chan string, 1000) // Pubkeys whose history needs importing
+	onboardingInFlight sync.Map
+)
+
+// OnboardingJob tracks the import of a user's own history
+type OnboardingJob struct {
+	PubKey        string     `json:"pubkey"`
+	Status        string     `json:"status"` // queued, running, done or failed
+	Phase         string     `json:"phase,omitempty"`
+	EventsFetched int        `json:"eventsFetched"` // Handed to the database, which skips some
+	Error         string     `json:"error,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	StartedAt     *time.Time `json:"startedAt,omitempty"`
+	FinishedAt    *time.Time `json:"finishedAt,omitempty"`
+}
+
+// enqueueOnboarding queues an import of the user's history unless one has
+// already run. The relay only has data since it started, so without it a new
+// user's top authors and follows are almost empty.
+func enqueueOnboarding(pubkey string) {
+	if len(pubkey) != PubkeyLength {
+		return
+	}
+	if _, loaded := onboardingInFlight.LoadOrStore(pubkey, true); loaded {
+		return
+	}
+
+	queued, err := repository.createOnboardingJob(pubkey)
+	if err != nil {
+		log.Printf("Error creating onboarding job for %s: %v", pubkey, err)
+		onboardingInFlight.Delete(pubkey)
+		return
+	}
+	if !queued {
+		// Already done, or failed recently. Keep the pubkey in the map so the
+		// database isn't asked again on every feed request.
+		return
+	}
+
+	select {
+	case onboardingQueue <- pubkey:
+	default:
+		// Queue is full, the job stays queued and the next request tries again
+		onboardingInFlight.Delete(pubkey)
+	}
+}
+
+// startOnboarding starts the onboarding workers and requeues jobs that were
+// interrupted by a restart
+func startOnboarding(ctx context.Context) {
+	for i := 0; i < onboardingWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case pubkey := <-onboardingQueue:
+					runOnboarding(ctx, pubkey)
+				}
+			}
+		}()
+	}
+
+	pubkeys, err := repository.unfinishedOnboardingJobs()
+	if err != nil {
+		log.Printf("Error loading onboarding jobs: %v", err)
+		return
+	}
+	for _, pubkey := range pubkeys {
+		onboardingInFlight.Store(pubkey, true)
+		select {
+		case onboardingQueue <- pubkey:
+		default:
+			onboardingInFlight.Delete(pubkey)
+		}
+	}
+}
+
+func runOnboarding(ctx context.Context, pubkey string) {
+	log.Printf("👋 onboarding %s", pubkey)
+	if err := repository.startOnboardingJob(pubkey); err != nil {
+		log.Printf("Error starting onboarding job for %s: %v", pubkey, err)
+	}
+
+	fetched, err := importUserHistory(ctx, pubkey)
+	if err != nil {
+		log.Printf("Onboarding %s failed: %v", pubkey, err)
+		// Let a later request retry once onboardingRetryInterval has passed
+		onboardingInFlight.Delete(pubkey)
+	} else {
+		log.Printf("✅ onboarded %s with %d events fetched", pubkey, fetched)
+	}
+
+	if err := repository.finishOnboardingJob(pubkey, fetched, err); err != nil {
+		log.Printf("Error finishing onboarding job for %s: %v", pubkey, err)
+	}
+	invalidateUserFeedCache(pubkey)
+}
+
+// importUserHistory fetches the user's reactions, zaps, replies and follow list
+// from the upstream relays and the user's own NIP-65 write relays, along with
+// the notes they engaged with, and saves them. It returns how many events were
+// handed to the database, which skips duplicates and engagement on unknown notes.
+func importUserHistory(ctx context.Context, pubkey string) (int, error) {
+	setPhase := func(phase string, fetched int) {
+		if err := repository.updateOnboardingProgress(pubkey, phase, fetched); err != nil {
+			log.Printf("Error updating onboarding job for %s: %v", pubkey, err)
+		}
+	}
+
+	setPhase("relays", 0)
+	relays := currentRelays()
+	if relayList := fetchLatestEvent(ctx, relays, nostr.Filter{Kinds: []int{10002}, Authors: []string{pubkey}}); relayList != nil {
+		if err := repository.SaveNostrEvent(relayList); err != nil {
+			log.Printf("Error saving relay list for %s: %v", pubkey, err)
+		}
+		// Anyone can publish a relay list, so only public relays are dialed
+		_, write := parseRelayList(relayList)
+		var public []string
+		for _, url := range write {
+			if len(public) == onboardingOutboxRelays {
+				break
+			}
+			if isPublicRelayURL(ctx, url) {
+				public = append(public, url)
+			}
+		}
+		relays = mergeRelayURLs(relays, public)
+	}
+	if len(relays) == 0 {
+		return 0, fmt.Errorf("no relays to import from")
+	}
+
+	setPhase("activity", 0)
+	since := nostr.Timestamp(time.Now().Add(-onboardingLookback).Unix())
+	activity := fetchVerifiedEvents(ctx, relays, nostr.Filters{
+		{Kinds: []int{1, 1111, 7, 6, 16}, Authors: []string{pubkey}, Since: &since, Limit: onboardingLimit},
+		{Kinds: []int{9735}, Tags: nostr.TagMap{"P": []string{pubkey}}, Since: &since, Limit: onboardingLimit},
+	})
+	followList := fetchLatestEvent(ctx, relays, nostr.Filter{Kinds: []int{3}, Authors: []string{pubkey}})
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+
+	// Engagement is only stored for notes the relay knows, so fetch the notes
+	// the user reacted to, zapped or replied to first
+	setPhase("notes", len(activity))
+	referenced := make(map[string]bool)
+	for _, event := range activity {
+		if noteID := engagedNoteID(event); noteID != "" {
+			referenced[noteID] = true
+		}
+	}
+	missing, err := repository.missingNoteIDs(referenced)
+	if err != nil {
+		return 0, err
+	}
+	var notes []*nostr.Event
+	for start := 0; start < len(missing); start += onboardingNoteChunk {
+		end := start + onboardingNoteChunk
+		if end > len(missing) {
+			end = len(missing)
+		}
+		notes = append(notes, fetchVerifiedEvents(ctx, relays, nostr.Filters{{IDs: missing[start:end]}})...)
+	}
+
+	setPhase("saving", len(activity)+len(notes))
+	batch := &eventBatch{}
+	for _, event := range append(notes, activity...) {
+		// Malformed events and zaps that fail validation are skipped
+		repository.addToBatch(event, batch)
+	}
+	if err := repository.insertBatch(ctx, batch); err != nil {
+		return 0, err
+	}
+	fetched := batch.size()
+
+	if followList != nil {
+		if err := repository.SaveNostrEvent(followList); err != nil {
+			return fetched, err
+		}
+		fetched++
+	}
+
+	return fetched, nil
+}
+
+// engagedNoteID returns the note a reaction, zap, repost or reply is about
+func engagedNoteID(event *nostr.Event) string {
+	switch event.Kind {
+	case 7, 9735, 6, 16:
+		noteID, err := getTaggedNoteID(event)
+		if err != nil {
+			return ""
+		}
+		return noteID
+	default:
+		return getRootNoteID(event)
+	}
+}
+
+// fetchVerifiedEvents queries the relays until they all send EOSE or the
+// timeout passes, dropping duplicates and events with bad IDs. The pool has
+// already dropped events with bad signatures.
+func fetchVerifiedEvents(ctx context.Context, relays []string, filters nostr.Filters) []*nostr.Event {
+	queryCtx, cancel := context.WithTimeout(ctx, onboardingTimeout)
+	defer cancel()
+
+	seen := make(map[string]bool)
+	var events []*nostr.Event
+	for ev := range pool.SubManyEose(queryCtx, relays, filters) {
+		if seen[ev.Event.ID] || !ev.Event.CheckID() {
+			continue
+		}
+		seen[ev.Event.ID] = true
+		events = append(events, ev.Event)
+	}
+	return events
+}
+
+// fetchLatestEvent returns the newest event matching the filter, for
+// replaceable kinds
+func fetchLatestEvent(ctx context.Context, relays []string, filter nostr.Filter) *nostr.Event {
+	var latest *nostr.Event
+	for _, event := range fetchVerifiedEvents(ctx, relays, nostr.Filters{filter}) {
+		if latest == nil || event.CreatedAt > latest.CreatedAt {
+			latest = event
+		}
+	}
+	return latest
+}
+
+// parseRelayList reads the read and write relays from a NIP-65 relay list.
+// A relay without a marker is used for both.
+func parseRelayList(event *nostr.Event) (read, write []string) {
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "r" || !nostr.IsValidRelayURL(tag[1]) {
+			continue
+		}
+		url := nostr.NormalizeURL(tag[1])
+		marker := ""
+		if len(tag) >= 3 {
+			marker = tag[2]
+		}
+		if marker == "" || marker == "read" {
+			read = append(read, url)
+		}
+		if marker == "" || marker == "write" {
+			write = append(write, url)
+		}
+	}
+	return read, write
+}
+
+// mergeRelayURLs appends the extra relays that aren't already in the list
+func mergeRelayURLs(relays, extra []string) []string {
+	merged := append([]string(nil), relays...)
+	known := make(map[string]bool, len(relays))
+	for _, url := range relays {
+		known[url] = true
+	}
+	for _, url := range extra {
+		if !known[url] {
+			known[url] = true
+			merged = append(merged, url)
+		}
+	}
+	return merged
+}
+
+// missingNoteIDs returns the IDs that aren't in the notes table
+func (r *NostrRepository) missingNoteIDs(ids map[string]bool) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	all := make([]string, 0, len(ids))
+	for id := range ids {
+		all = append(all, id)
+	}
+	sort.Strings(all)
+
+	query := `
+		SELECT t.id FROM unnest($1::text[]) AS t(id)
+		WHERE NOT EXISTS (SELECT 1 FROM notes n WHERE n.id = t.id)
+	`
+	rows, err := r.db.QueryContext(context.Background(), query, pq.Array(all))
+	if err != nil {
+		return nil, fmt.Errorf("error checking known notes: %v", err)
+	}
+	defer rows.Close()
+
+	var missing []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		missing = append(missing, id)
+	}
+	return missing, rows.Err()
+}
+
+// createOnboardingJob queues a job for the user. It returns false when a job
+// already ran, or failed less than onboardingRetryInterval ago.
+func (r *NostrRepository) createOnboardingJob(pubkey string) (bool, error) {
+	query := `
+        INSERT INTO onboarding_jobs (pubkey, status, created_at)
+        VALUES ($1, 'queued', NOW())
+        ON CONFLICT (pubkey) DO UPDATE SET
+            status = 'queued',
+            phase = NULL,
+            error = NULL
+        WHERE onboarding_jobs.status = 'queued'
+            OR (onboarding_jobs.status = 'failed' AND onboarding_jobs.finished_at < $2)
+        RETURNING pubkey;
+    `
+	var queued string
+	err := r.db.QueryRowContext(context.Background(), query, pubkey, time.Now().Add(-onboardingRetryInterval).UTC()).Scan(&queued)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error creating onboarding job: %v", err)
+	}
+	return true, nil
+}
+
+func (r *NostrRepository) startOnboardingJob(pubkey string) error {
+	query := `UPDATE onboarding_jobs SET status = 'running', events_fetched = 0, started_at = NOW() WHERE pubkey = $1`
+	if _, err := r.db.ExecContext(context.Background(), query, pubkey); err != nil {
+		return fmt.Errorf("error starting onboarding job: %v", err)
+	}
+	return nil
+}
+
+func (r *NostrRepository) updateOnboardingProgress(pubkey, phase string, eventsFetched int) error {
+	query := `UPDATE onboarding_jobs SET phase = $2, events_fetched = $3 WHERE pubkey = $1`
+	if _, err := r.db.ExecContext(context.Background(), query, pubkey, phase, eventsFetched); err != nil {
+		return fmt.Errorf("error updating onboarding job: %v", err)
+	}
+	return nil
+}
+
+func (r *NostrRepository) finishOnboardingJob(pubkey string, eventsFetched int, jobErr error) error {
+	status, errMsg := "done", sql.NullString{}
+	if jobErr != nil {
+		status, errMsg = "failed", sql.NullString{String: jobErr.Error(), Valid: true}
+	}
+
+	query := `
+        UPDATE onboarding_jobs
+        SET status = $2, phase = NULL, events_fetched = $3, error = $4, finished_at = NOW()
+        WHERE pubkey = $1
+    `
+	if _, err := r.db.ExecContext(context.Background(), query, pubkey, status, eventsFetched, errMsg); err != nil {
+		return fmt.Errorf("error finishing onboarding job: %v", err)
+	}
+	return nil
+}
+
+// unfinishedOnboardingJobs returns the pubkeys of jobs that were queued or
+// running when the relay stopped
+func (r *NostrRepository) unfinishedOnboardingJobs() ([]string, error) {
+	query := `SELECT pubkey FROM onboarding_jobs WHERE status IN ('queued', 'running') ORDER BY created_at`
+	rows, err := r.db.QueryContext(context.Background(), query)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching onboarding jobs: %v", err)
+	}
+	defer rows.Close()
+
+	var pubkeys []string
+	for rows.Next() {
+		var pubkey string
+		if err := rows.Scan(&pubkey); err != nil {
+			return nil, err
+		}
+		pubkeys = append(pubkeys, pubkey)
+	}
+	return pubkeys, rows.Err()
+}
+
+func (r *NostrRepository) GetOnboardingJob(pubkey string) (OnboardingJob, error) {
+	query := `
+        SELECT pubkey, status, COALESCE(phase, ''), events_fetched, COALESCE(error, ''),
+            created_at, started_at, finished_at
+        FROM onboarding_jobs
+        WHERE pubkey = $1
+    `
+	var job OnboardingJob
+	var startedAt, finishedAt sql.NullTime
+	err := r.db.QueryRowContext(context.Background(), query, pubkey).Scan(&job.PubKey, &job.Status, &job.Phase,
+		&job.EventsFetched, &job.Error, &job.CreatedAt, &startedAt, &finishedAt)
+	if err != nil {
+		return OnboardingJob{}, err
+	}
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	return job, nil
+}
+
+// handleOnboardingAPI reports the progress of a user's onboarding import
+func handleOnboardingAPI(w http.ResponseWriter, r *http.Request, pubkey string) {
+	job, err := repository.GetOnboardingJob(pubkey)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No onboarding job for this pubkey", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error fetching onboarding job: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		http.Error(w, "Error encoding response: "+err.Error(), http.StatusInternalServerError)
+	}
+}
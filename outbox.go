@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	outboxRefreshInterval = 15 * time.Minute
+	outboxTopAuthors      = 50  // Top interacted authors per user followed to their relays
+	outboxRelaysPerAuthor = 2   // Write relays subscribed to per author
+	outboxMaxRelays       = 50  // Cap on outbox connections
+	outboxMaxRelayAuthors = 500 // Cap on authors in one outbox subscription
+)
+
+// outboxRelays are the write relays of authors the relay's users care about
+// that none of the configured relays carry (the NIP-65 outbox model). They
+// are kept apart from upstreamRelays so a config reload doesn't drop them.
+var outboxRelays = relayRegistry{relays: make(map[string]*upstreamRelay)}
+
+// runOutbox periodically recomputes which outbox relays to subscribe to
+func runOutbox(ctx context.Context) {
+	ticker := time.NewTicker(outboxRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := refreshOutbox(ctx); err != nil {
+			log.Printf("Error refreshing outbox relays: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func refreshOutbox(ctx context.Context) error {
+	authors, err := repository.outboxAuthors()
+	if err != nil {
+		return err
+	}
+	writeRelays, err := repository.GetWriteRelays(authors)
+	if err != nil {
+		return err
+	}
+	writeRelays = publicWriteRelays(ctx, writeRelays)
+	assignments := assignOutboxRelays(writeRelays, currentRelays())
+
+	outboxRelays.Lock()
+	defer outboxRelays.Unlock()
+
+	for url, outbox := range outboxRelays.relays {
+		if _, wanted := assignments[url]; !wanted {
+			outbox.cancel()
+			delete(outboxRelays.relays, url)
+		}
+	}
+
+	covered := 0
+	for url, assigned := range assignments {
+		covered += len(assigned)
+		if outbox, exists := outboxRelays.relays[url]; exists {
+			outbox.setAuthors(assigned)
+			continue
+		}
+		relayCtx, cancel := context.WithCancel(ctx)
+		outbox := &upstreamRelay{
+			stats:   RelayStats{URL: url, Outbox: true, Authors: len(assigned)},
+			cancel:  cancel,
+			authors: assigned,
+		}
+		outboxRelays.relays[url] = outbox
+		go outbox.run(relayCtx)
+	}
+
+	log.Printf("Subscribed to %d outbox relays for %d author subscriptions", len(assignments), covered)
+	return nil
+}
+
+// publicWriteRelays drops write relays on loopback, private or link-local
+// addresses. Relay lists are published by anyone, so they could otherwise
+// point the relay at internal services.
+func publicWriteRelays(ctx context.Context, writeRelays map[string][]string) map[string][]string {
+	public := make(map[string]bool)
+	filtered := make(map[string][]string, len(writeRelays))
+	for author, relays := range writeRelays {
+		var kept []string
+		for _, url := range relays {
+			ok, checked := public[url]
+			if !checked {
+				ok = isPublicRelayURL(ctx, url)
+				public[url] = ok
+			}
+			if ok {
+				kept = append(kept, url)
+			}
+		}
+		if len(kept) > 0 {
+			filtered[author] = kept
+		}
+	}
+	return filtered
+}
+
+// assignOutboxRelays picks the relays to read each author from. Authors who
+// publish to one of the configured relays are already covered. The others are
+// read from their most widely shared write relays, so the fewest connections
+// cover the most authors.
+func assignOutboxRelays(writeRelays map[string][]string, configured []string) map[string][]string {
+	isConfigured := make(map[string]bool, len(configured))
+	for _, url := range configured {
+		isConfigured[url] = true
+	}
+
+	uncovered := make(map[string][]string)
+	popularity := make(map[string]int)
+	for author, relays := range writeRelays {
+		if slices.ContainsFunc(relays, func(url string) bool { return isConfigured[url] }) {
+			continue
+		}
+		uncovered[author] = relays
+		for _, url := range relays {
+			popularity[url]++
+		}
+	}
+
+	assignments := make(map[string][]string)
+	for author, relays := range uncovered {
+		relays = append([]string(nil), relays...)
+		sort.SliceStable(relays, func(i, j int) bool {
+			return popularity[relays[i]] > popularity[relays[j]]
+		})
+		if len(relays) > outboxRelaysPerAuthor {
+			relays = relays[:outboxRelaysPerAuthor]
+		}
+		for _, url := range relays {
+			assignments[url] = append(assignments[url], author)
+		}
+	}
+
+	// Keep the relays covering the most authors
+	urls := make([]string, 0, len(assignments))
+	for url := range assignments {
+		urls = append(urls, url)
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		if len(assignments[urls[i]]) != len(assignments[urls[j]]) {
+			return len(assignments[urls[i]]) > len(assignments[urls[j]])
+		}
+		return urls[i] < urls[j]
+	})
+	for i, url := range urls {
+		if i >= outboxMaxRelays {
+			delete(assignments, url)
+			continue
+		}
+		sort.Strings(assignments[url])
+		if len(assignments[url]) > outboxMaxRelayAuthors {
+			assignments[url] = assignments[url][:outboxMaxRelayAuthors]
+		}
+	}
+	return assignments
+}
+
+// setAuthors changes the authors an outbox relay is asked for, reconnecting
+// if they changed
+func (u *upstreamRelay) setAuthors(authors []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if slices.Equal(u.authors, authors) {
+		return
+	}
+	u.authors = authors
+	u.stats.Authors = len(authors)
+	u.resubscribe = true
+	if u.cancelSubscription != nil {
+		u.cancelSubscription()
+	}
+}
+
+// takeResubscribe reports whether the subscription ended because its authors
+// changed, clearing the flag
+func (u *upstreamRelay) takeResubscribe() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	resubscribe := u.resubscribe
+	u.resubscribe = false
+	return resubscribe
+}
+
+// saveRelayList stores the read and write relays from a NIP-65 relay list,
+// keeping only the newest list per author
+func (r *NostrRepository) saveRelayList(event *nostr.Event) error {
+	read, write := parseRelayList(event)
+	if read == nil {
+		read = []string{}
+	}
+	if write == nil {
+		write = []string{}
+	}
+
+	query := `
+        INSERT INTO relay_lists (pubkey, event_id, read_relays, write_relays, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, to_timestamp($5), NOW())
+        ON CONFLICT (pubkey) DO UPDATE SET
+            event_id = EXCLUDED.event_id,
+            read_relays = EXCLUDED.read_relays,
+            write_relays = EXCLUDED.write_relays,
+            created_at = EXCLUDED.created_at,
+            updated_at = NOW()
+        WHERE relay_lists.created_at < EXCLUDED.created_at;
+    `
+	_, err := r.db.ExecContext(context.Background(), query, event.PubKey, event.ID,
+		pq.Array(read), pq.Array(write), event.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error saving relay list: %v", err)
+	}
+	return nil
+}
+
+// GetWriteRelays returns the write relays of the authors that published a relay list
+func (r *NostrRepository) GetWriteRelays(authors []string) (map[string][]string, error) {
+	query := `
+        SELECT pubkey, write_relays
+        FROM relay_lists
+        WHERE pubkey = ANY($1) AND cardinality(write_relays) > 0
+    `
+	rows, err := r.db.QueryContext(context.Background(), query, pq.Array(authors))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching relay lists: %v", err)
+	}
+	defer rows.Close()
+
+	writeRelays := make(map[string][]string)
+	for rows.Next() {
+		var pubkey string
+		var relays []string
+		if err := rows.Scan(&pubkey, pq.Array(&relays)); err != nil {
+			return nil, err
+		}
+		writeRelays[pubkey] = relays
+	}
+	return writeRelays, rows.Err()
+}
+
+// outboxAuthors returns the authors followed by the relay's users, and the
+// ones each user interacts with most, in one query over all users. The users
+// are the pubkeys that saved settings or were onboarded.
+func (r *NostrRepository) outboxAuthors() ([]string, error) {
+	query := `
+		WITH users AS (
+			SELECT pubkey FROM pubkey_settings
+			UNION
+			SELECT pubkey FROM onboarding_jobs
+		),
+		interactions AS (
+			-- Same signals as fetchTopInteractedAuthors, dislikes count against the author
+			SELECT z.zapper_id AS user_id, p.author_id, 1 AS weight
+			FROM zaps z JOIN notes p ON p.id = z.note_id
+			WHERE z.zapper_id IN (SELECT pubkey FROM users)
+			UNION ALL
+			SELECT r.reactor_id, p.author_id, CASE WHEN r.reaction_type = 'dislike' THEN -1 ELSE 1 END
+			FROM reactions r JOIN notes p ON p.id = r.note_id
+			WHERE r.reactor_id IN (SELECT pubkey FROM users)
+			UNION ALL
+			SELECT c.commenter_id, p.author_id, 1
+			FROM comments c JOIN notes p ON p.id = c.note_id
+			WHERE c.commenter_id IN (SELECT pubkey FROM users)
+			UNION ALL
+			SELECT rp.reposter_id, p.author_id, 1
+			FROM reposts rp JOIN notes p ON p.id = rp.note_id
+			WHERE rp.reposter_id IN (SELECT pubkey FROM users)
+		),
+		ranked AS (
+			SELECT author_id, SUM(weight) AS interaction_count,
+				ROW_NUMBER() OVER (PARTITION BY user_id ORDER BY SUM(weight) DESC) AS position
+			FROM interactions
+			GROUP BY user_id, author_id
+		)
+		SELECT f.follow_id FROM follows f
+		WHERE f.pubkey IN (SELECT pubkey FROM users) AND f.follow_id <> f.pubkey
+		UNION
+		SELECT author_id FROM ranked
+		WHERE position <= $1 AND interaction_count > 0
+`
+	rows, err := r.db.QueryContext(context.Background(), query, outboxTopAuthors)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching outbox authors: %v", err)
+	}
+	defer rows.Close()
+
+	var authors []string
+	for rows.Next() {
+		var pubkey string
+		if err := rows.Scan(&pubkey); err != nil {
+			return nil, err
+		}
+		authors = append(authors, pubkey)
+	}
+	return authors, rows.Err()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	defaultPreviewLimit = 20
+	maxPreviewLimit     = variantFeedSize
+)
+
+// PreviewRequest carries unsaved settings to rank the caller's feed with
+type PreviewRequest struct {
+	Settings UserSettings `json:"settings"`
+	Kinds    []int        `json:"kinds"`
+	Limit    int          `json:"limit"`
+}
+
+// handleFeedPreviewAPI ranks the caller's feed with the settings in the body
+// and returns the top notes with their score breakdowns. Nothing is saved and
+// the feed cache is left alone, so clients keep being served the saved ranking.
+func handleFeedPreviewAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var previewReq PreviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&previewReq); err != nil {
+		http.Error(w, "Invalid request format: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	settings := previewReq.Settings
+	settings.PubKey = authedPubkey(r)
+	if err := validateSettings(settings); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := previewReq.Limit
+	if limit <= 0 {
+		limit = defaultPreviewLimit
+	}
+	if limit > maxPreviewLimit {
+		limit = maxPreviewLimit
+	}
+
+	kinds := normalizeKinds(previewReq.Kinds)
+	feedVariants, err := buildFeedVariants(r.Context(), settings.PubKey, kinds, settings)
+	if err != nil {
+		http.Error(w, "Error building preview: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Variants mix the same candidates differently, the first is enough to
+	// see the effect of the settings
+	preview := []FeedExplanation{}
+	if len(feedVariants) > 0 {
+		for position, note := range feedVariants[0] {
+			if position >= limit {
+				break
+			}
+			preview = append(preview, newFeedExplanation(note, kinds, position))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(preview); err != nil {
+		http.Error(w, "Error encoding response: "+err.Error(), http.StatusInternalServerError)
+	}
+}
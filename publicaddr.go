@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const relayLookupTimeout = 2 * time.Second
+
+// isPublicIP reports whether the IP is routable on the internet, as opposed to
+// loopback, private, link-local (like 169.254.169.254) or unspecified
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsUnspecified()
+}
+
+// rejectNonPublicAddress is a net.Dialer Control function that refuses
+// connections to non-public IPs. It runs after DNS resolution and on every
+// redirect, so hostnames pointing inside the network are caught too.
+func rejectNonPublicAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("refusing to connect to non-public address %s", host)
+	}
+	return nil
+}
+
+// isPublicRelayURL reports whether a relay URL taken from someone's relay list
+// points at a public host. Hostnames are resolved, so names pointing inside
+// the network are refused too.
+func isPublicRelayURL(ctx context.Context, relayURL string) bool {
+	parsed, err := url.Parse(relayURL)
+	if err != nil || (parsed.Scheme != "wss" && parsed.Scheme != "ws") || parsed.User != nil {
+		return false
+	}
+	host := parsed.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		return isPublicIP(ip)
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || !strings.Contains(host, ".") {
+		return false
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, relayLookupTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(lookupCtx, host)
+	if err != nil || len(addrs) == 0 {
+		return false
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// isHTTPSURL reports whether the URL is an absolute https URL without credentials
+func isHTTPSURL(raw string) bool {
+	parsed, err := url.Parse(raw)
+	return err == nil && parsed.Scheme == "https" && parsed.Host != "" && parsed.User == nil
+}
@@ -0,0 +1,725 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// defaultRelays are used when neither RELAYS_FILE nor RELAYS is set
+var defaultRelays = []string{
+	"wss://relay.lexingtonbitcoin.org",
+	"wss://nostr.600.wtf",
+	"wss://nostr.hexhex.online",
+	"wss://wot.utxo.one",
+	"wss://nostrelites.org",
+	"wss://wot.nostr.party",
+	"wss://wot.puhcho.me",
+	"wss://wot.girino.org",
+	"wss://relay.beeola.me",
+	"wss://zap.watch",
+	"wss://wot.yeghro.site",
+	"wss://wot.innovativecerebrum.ai",
+	"wss://wot.swarmstr.com",
+	"wss://wot.azzamo.net",
+	"wss://satsage.xyz",
+	"wss://wot.sandwich.farm",
+	"wss://wons.calva.dev",
+	"wss://wot.shaving.kiwi",
+	"wss://wot.tealeaf.dev",
+	"wss://wot.dtonon.com",
+	"wss://wot.relay.vanderwarker.family",
+	"wss://wot.zacoos.com",
+	"wss://nos.lol",
+	"wss://nostr.mom",
+	"wss://purplepag.es",
+	"wss://purplerelay.com",
+	"wss://relay.damus.io",
+	"wss://relay.nostr.band",
+	"wss://relay.snort.social",
+	"wss://relayable.org",
+	"wss://relay.primal.net",
+	"wss://relay.nostr.bg",
+	"wss://no.str.cr",
+	"wss://nostr21.com",
+	"wss://nostrue.com",
+	"wss://relay.siamstr.com",
+}
+
+// subscribedKinds are the event kinds ingested from upstream relays
+var subscribedKinds = []int{
+	nostr.KindTextNote,
+	1111, // KindComment
+	nostr.KindReaction,
+	nostr.KindRepost,
+	nostr.KindGenericRepost,
+	nostr.KindZap,
+	nostr.KindFollowList,
+	nostr.KindArticle,
+	20,    // KindImage
+	10000, // KindMuteList
+	1984,  // KindReporting
+	5,     // KindDeletion
+	nostr.KindProfileMetadata,
+	nostr.KindRelayListMetadata,
+}
+
+const (
+	relayConfigPollInterval = 30 * time.Second
+	relayMinBackoff         = 30 * time.Second
+	relayMaxBackoff         = 30 * time.Minute
+	relayStableAfter        = time.Minute // A connection this old resets the backoff
+	seenEventsCapacity      = 100000
+
+	checkpointFlushInterval = 30 * time.Second
+	checkpointOverlap       = 5 * time.Minute // Re-read a little before the checkpoint for late events
+	maxBackfill             = 3 * 24 * time.Hour
+	backfillWindow          = time.Hour
+	backfillWindowTimeout   = 10 * time.Second
+	backfillLimit           = 500         // Events asked for per window, fuller windows are split
+	minBackfillWindow       = time.Minute // Windows aren't split any further than this
+
+	invalidEventWindow = 10 * time.Minute
+	relayDropDuration  = 6 * time.Hour
+)
+
+// invalidEventLimit is how many events with a bad ID or signature a relay may
+// send within invalidEventWindow before it is dropped for relayDropDuration
+var invalidEventLimit = 20
+
+// RelayStats tracks the health of an upstream relay
+type RelayStats struct {
+	URL            string    `json:"url"`
+	Connected      bool      `json:"connected"`
+	EventsReceived int64     `json:"eventsReceived"`
+	Duplicates     int64     `json:"duplicates"`
+	Invalid        int64     `json:"invalid"`  // Events with a bad ID or signature
+	Rejected       int64     `json:"rejected"` // Events with invalid content
+	Errors         int64     `json:"errors"`   // Failed connections and dropped subscriptions
+	LastError      string    `json:"lastError,omitempty"`
+	LastSeen       time.Time `json:"lastSeen"`
+	ConnectedAt    time.Time `json:"connectedAt"`
+	BackoffUntil   time.Time `json:"backoffUntil"`
+	Checkpoint     time.Time `json:"checkpoint"`
+	Backfilling    bool      `json:"backfilling"`
+	DroppedUntil   time.Time `json:"droppedUntil"`      // Set when the relay sent too many invalid events
+	Outbox         bool      `json:"outbox,omitempty"`  // Picked from authors' relay lists rather than the config
+	Authors        int       `json:"authors,omitempty"` // Authors an outbox relay is subscribed to
+}
+
+type upstreamRelay struct {
+	mu        sync.Mutex
+	stats     RelayStats
+	failures  int // Consecutive failed connections
+	cancel    context.CancelFunc
+	highWater nostr.Timestamp // Newest created_at received
+	saved     nostr.Timestamp // Last persisted high-water mark
+
+	cancelSubscription context.CancelFunc
+	invalidSince       time.Time // Start of the current invalid event window
+	invalidInWindow    int
+
+	authors     []string // Outbox relays are only asked for these authors' events
+	resubscribe bool     // Set when the authors change, to reconnect without backing off
+}
+
+// relayRegistry holds the relays being subscribed to, by URL
+type relayRegistry struct {
+	sync.Mutex
+	relays map[string]*upstreamRelay
+}
+
+var upstreamRelays = relayRegistry{relays: make(map[string]*upstreamRelay)}
+
+// currentRelays returns the URLs of the configured upstream relays
+func currentRelays() []string {
+	upstreamRelays.Lock()
+	defer upstreamRelays.Unlock()
+
+	urls := make([]string, 0, len(upstreamRelays.relays))
+	for url := range upstreamRelays.relays {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// loadRelayConfig reads the upstream relays from RELAYS_FILE (one URL per
+// line, # for comments) or the comma separated RELAYS variable
+func loadRelayConfig() ([]string, error) {
+	var entries []string
+	if path := os.Getenv("RELAYS_FILE"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("error opening relays file: %v", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			entries = append(entries, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error reading relays file: %v", err)
+		}
+	} else if env := os.Getenv("RELAYS"); env != "" {
+		entries = strings.Split(env, ",")
+	} else {
+		return defaultRelays, nil
+	}
+
+	seen := make(map[string]bool)
+	urls := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		url := nostr.NormalizeURL(entry)
+		if !nostr.IsValidRelayURL(url) {
+			log.Printf("Ignoring invalid relay URL: %s", entry)
+			continue
+		}
+		if !seen[url] {
+			seen[url] = true
+			urls = append(urls, url)
+		}
+	}
+
+	if len(urls) == 0 {
+		return nil, errors.New("no valid relays configured")
+	}
+	return urls, nil
+}
+
+// reloadRelays applies the relay config, connecting to added relays and
+// dropping removed ones. Relays that are kept keep their connection and stats.
+func reloadRelays(ctx context.Context) error {
+	urls, err := loadRelayConfig()
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool, len(urls))
+	for _, url := range urls {
+		wanted[url] = true
+	}
+
+	upstreamRelays.Lock()
+	defer upstreamRelays.Unlock()
+
+	for url, upstream := range upstreamRelays.relays {
+		if !wanted[url] {
+			log.Printf("Removing upstream relay %s", url)
+			upstream.cancel()
+			delete(upstreamRelays.relays, url)
+		}
+	}
+
+	for _, url := range urls {
+		if _, exists := upstreamRelays.relays[url]; exists {
+			continue
+		}
+		relayCtx, cancel := context.WithCancel(ctx)
+		upstream := &upstreamRelay{stats: RelayStats{URL: url}, cancel: cancel}
+		upstreamRelays.relays[url] = upstream
+		go upstream.run(relayCtx)
+	}
+
+	log.Printf("Subscribed to %d upstream relays", len(urls))
+	return nil
+}
+
+// watchRelayConfig reloads the relay list when RELAYS_FILE changes
+func watchRelayConfig(ctx context.Context) {
+	path := os.Getenv("RELAYS_FILE")
+	if path == "" {
+		return
+	}
+
+	var lastModified time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastModified = info.ModTime()
+	}
+
+	ticker := time.NewTicker(relayConfigPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil || !info.ModTime().After(lastModified) {
+				continue
+			}
+			lastModified = info.ModTime()
+			log.Println("Relays file changed, reloading")
+			if err := reloadRelays(ctx); err != nil {
+				log.Printf("Error reloading relays: %v", err)
+			}
+		}
+	}
+}
+
+// run keeps a subscription to the relay open, backing off exponentially
+// while the relay keeps failing
+func (u *upstreamRelay) run(ctx context.Context) {
+	checkpoint, err := repository.GetRelayCheckpoint(u.url())
+	if err != nil {
+		log.Printf("Error loading checkpoint for %s: %v", u.url(), err)
+	}
+	u.mu.Lock()
+	u.highWater, u.saved = checkpoint, checkpoint
+	if checkpoint > 0 {
+		u.stats.Checkpoint = checkpoint.Time()
+	}
+	u.mu.Unlock()
+
+	for ctx.Err() == nil {
+		subscriptionCtx, cancel := context.WithCancel(ctx)
+		u.mu.Lock()
+		u.cancelSubscription = cancel
+		u.mu.Unlock()
+
+		err := u.subscribe(subscriptionCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if u.takeResubscribe() {
+			continue
+		}
+
+		var wait time.Duration
+		if droppedUntil := u.droppedUntil(); !droppedUntil.IsZero() {
+			wait = time.Until(droppedUntil)
+		} else {
+			wait = u.recordDisconnect(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (u *upstreamRelay) subscribe(ctx context.Context) error {
+	defer u.flushCheckpoint()
+
+	relay, err := ingestPool.EnsureRelay(u.url())
+	if err != nil {
+		return err
+	}
+	// Signatures are checked by the ingestion workers, in parallel and per relay
+	relay.AssumeValid = true
+
+	// Catch up on what was missed since the checkpoint before going live
+	now := nostr.Now()
+	if from := u.resumeFrom(now); from < now {
+		if err := u.backfill(ctx, from, now); err != nil {
+			return err
+		}
+	}
+
+	filters := nostr.Filters{u.filter(&now, nil)}
+
+	sub, err := relay.Subscribe(ctx, filters)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsub()
+
+	u.recordConnect()
+
+	ticker := time.NewTicker(checkpointFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			u.flushCheckpoint()
+		case <-relay.Context().Done():
+			return errors.New("connection lost")
+		case reason := <-sub.ClosedReason:
+			return fmt.Errorf("subscription closed: %s", reason)
+		case event, ok := <-sub.Events:
+			if !ok {
+				return errors.New("subscription ended")
+			}
+			u.handleEvent(ctx, event)
+		}
+	}
+}
+
+// resumeFrom returns where ingestion should pick up, a little before the last
+// checkpoint and no further back than maxBackfill. Relays without a
+// checkpoint start from now.
+func (u *upstreamRelay) resumeFrom(now nostr.Timestamp) nostr.Timestamp {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.highWater == 0 {
+		return now
+	}
+	from := u.highWater - nostr.Timestamp(checkpointOverlap.Seconds())
+	if oldest := now - nostr.Timestamp(maxBackfill.Seconds()); from < oldest {
+		from = oldest
+	}
+	return from
+}
+
+// backfill fetches stored events from the relay in windows, like the import
+// does, advancing the checkpoint only once a whole window has been fetched
+func (u *upstreamRelay) backfill(ctx context.Context, from, to nostr.Timestamp) error {
+	url := u.url()
+	log.Printf("Backfilling %s from %s", url, from.Time().Format(time.RFC3339))
+
+	u.setBackfilling(true)
+	defer u.setBackfilling(false)
+
+	window := nostr.Timestamp(backfillWindow.Seconds())
+	for start := from; start < to; start += window {
+		end := start + window
+		if end > to {
+			end = to
+		}
+		u.backfillRange(ctx, url, start, end)
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		u.advanceCheckpoint(end)
+		u.flushCheckpoint()
+	}
+	return nil
+}
+
+// backfillRange fetches one window of stored events. Relays cut results at
+// their own limit, so a window that fills the limit or times out is split in
+// half and fetched again, like importWindow.
+func (u *upstreamRelay) backfillRange(ctx context.Context, url string, since, until nostr.Timestamp) {
+	filter := u.filter(&since, &until)
+	filter.Limit = backfillLimit
+
+	windowCtx, cancel := context.WithTimeout(ctx, backfillWindowTimeout)
+	count := 0
+	for ev := range ingestPool.SubManyEose(windowCtx, []string{url}, nostr.Filters{filter}) {
+		u.receiveEvent(ctx, ev.Event)
+		count++
+	}
+	timedOut := windowCtx.Err() == context.DeadlineExceeded
+	cancel()
+
+	if ctx.Err() != nil || (count < backfillLimit && !timedOut) {
+		return
+	}
+	if until-since <= nostr.Timestamp(minBackfillWindow.Seconds()) {
+		log.Printf("Backfill window %d-%d on %s is still incomplete at the smallest window size", since, until, url)
+		return
+	}
+
+	// Events already fetched are dropped as duplicates by the pipeline
+	middle := since + (until-since)/2
+	u.backfillRange(ctx, url, since, middle)
+	u.backfillRange(ctx, url, middle, until)
+}
+
+// filter returns what the relay is asked for: every subscribed kind, and for
+// outbox relays only from the authors assigned to it
+func (u *upstreamRelay) filter(since, until *nostr.Timestamp) nostr.Filter {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return nostr.Filter{
+		Kinds:   subscribedKinds,
+		Authors: u.authors,
+		Since:   since,
+		Until:   until,
+	}
+}
+
+func (u *upstreamRelay) setBackfilling(backfilling bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.stats.Backfilling = backfilling
+}
+
+// advanceCheckpoint moves the high-water mark forward, never past now so a
+// single future-dated event can't make us skip a gap
+func (u *upstreamRelay) advanceCheckpoint(ts nostr.Timestamp) {
+	if now := nostr.Now(); ts > now {
+		ts = now
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if ts > u.highWater {
+		u.highWater = ts
+	}
+}
+
+// flushCheckpoint persists the high-water mark if it moved
+func (u *upstreamRelay) flushCheckpoint() {
+	u.mu.Lock()
+	url, highWater := u.stats.URL, u.highWater
+	changed := highWater > u.saved
+	u.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if err := repository.SaveRelayCheckpoint(url, highWater); err != nil {
+		log.Printf("Error saving checkpoint for %s: %v", url, err)
+		return
+	}
+
+	u.mu.Lock()
+	u.saved = highWater
+	u.stats.Checkpoint = highWater.Time()
+	u.mu.Unlock()
+}
+
+// handleEvent ingests an event from the live subscription
+func (u *upstreamRelay) handleEvent(ctx context.Context, event *nostr.Event) {
+	u.advanceCheckpoint(event.CreatedAt)
+	u.receiveEvent(ctx, event)
+}
+
+// receiveEvent counts and ingests an event without moving the checkpoint.
+// Backfill uses it directly, since a backfilled event's created_at doesn't mean
+// everything before it has been fetched.
+func (u *upstreamRelay) receiveEvent(ctx context.Context, event *nostr.Event) {
+	u.mu.Lock()
+	u.stats.EventsReceived++
+	u.stats.LastSeen = time.Now()
+	u.mu.Unlock()
+
+	enqueueEvent(ctx, event, u)
+}
+
+// recordDuplicate and recordRejected are called by the ingestion workers.
+// Events that didn't come from an upstream relay have no stats to update.
+func (u *upstreamRelay) recordDuplicate() {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.stats.Duplicates++
+}
+
+func (u *upstreamRelay) recordRejected() {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.stats.Rejected++
+}
+
+// recordInvalid counts an event with a bad ID or signature and drops the relay
+// when it keeps sending them
+func (u *upstreamRelay) recordInvalid() {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.stats.Invalid++
+
+	now := time.Now()
+	if now.Sub(u.invalidSince) > invalidEventWindow {
+		u.invalidSince = now
+		u.invalidInWindow = 0
+	}
+	u.invalidInWindow++
+
+	if u.invalidInWindow < invalidEventLimit || now.Before(u.stats.DroppedUntil) {
+		return
+	}
+	u.stats.DroppedUntil = now.Add(relayDropDuration)
+	u.invalidInWindow = 0
+	log.Printf("Dropping upstream relay %s for %v after %d invalid events", u.stats.URL, relayDropDuration, invalidEventLimit)
+	if u.cancelSubscription != nil {
+		u.cancelSubscription()
+	}
+}
+
+// droppedUntil returns when a dropped relay may be used again, or the zero time
+func (u *upstreamRelay) droppedUntil() time.Time {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if time.Now().Before(u.stats.DroppedUntil) {
+		return u.stats.DroppedUntil
+	}
+	return time.Time{}
+}
+
+func (u *upstreamRelay) url() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.stats.URL
+}
+
+func (u *upstreamRelay) recordConnect() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.stats.Connected = true
+	u.stats.ConnectedAt = time.Now()
+	u.stats.BackoffUntil = time.Time{}
+}
+
+// recordDisconnect notes the failure and returns how long to wait before reconnecting
+func (u *upstreamRelay) recordDisconnect(err error) time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	// A connection that stayed up for a while means the relay recovered
+	if u.stats.Connected && time.Since(u.stats.ConnectedAt) > relayStableAfter {
+		u.failures = 0
+	}
+	u.stats.Connected = false
+	u.stats.Errors++
+	if err != nil {
+		u.stats.LastError = err.Error()
+	}
+
+	wait := relayMinBackoff << u.failures
+	if wait > relayMaxBackoff || wait <= 0 {
+		wait = relayMaxBackoff
+	} else {
+		u.failures++
+	}
+	u.stats.BackoffUntil = time.Now().Add(wait)
+
+	log.Printf("Upstream relay %s disconnected (%v), retrying in %v", u.stats.URL, err, wait)
+	return wait
+}
+
+// GetRelayCheckpoint returns the relay's persisted high-water mark, or 0 if it has none
+func (r *NostrRepository) GetRelayCheckpoint(relayURL string) (nostr.Timestamp, error) {
+	query := `SELECT EXTRACT(EPOCH FROM last_event_at)::bigint FROM relay_checkpoints WHERE relay_url = $1`
+
+	var checkpoint int64
+	err := r.db.QueryRowContext(context.Background(), query, relayURL).Scan(&checkpoint)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error fetching relay checkpoint: %v", err)
+	}
+	return nostr.Timestamp(checkpoint), nil
+}
+
+// SaveRelayCheckpoint persists the relay's high-water mark. It only moves forward.
+func (r *NostrRepository) SaveRelayCheckpoint(relayURL string, checkpoint nostr.Timestamp) error {
+	query := `
+        INSERT INTO relay_checkpoints (relay_url, last_event_at, updated_at)
+        VALUES ($1, to_timestamp($2), NOW())
+        ON CONFLICT (relay_url) DO UPDATE SET
+            last_event_at = GREATEST(relay_checkpoints.last_event_at, EXCLUDED.last_event_at),
+            updated_at = NOW();
+    `
+	_, err := r.db.ExecContext(context.Background(), query, relayURL, checkpoint)
+	return err
+}
+
+// GetRelayStats returns a snapshot of the health of every upstream and outbox relay
+func GetRelayStats() []RelayStats {
+	var stats []RelayStats
+	for _, registry := range []*relayRegistry{&upstreamRelays, &outboxRelays} {
+		registry.Lock()
+		for _, upstream := range registry.relays {
+			upstream.mu.Lock()
+			stats = append(stats, upstream.stats)
+			upstream.mu.Unlock()
+		}
+		registry.Unlock()
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].URL < stats[j].URL
+	})
+	return stats
+}
+
+// seenEvents remembers recently ingested event IDs so copies arriving from
+// other relays are counted as duplicates instead of being saved again. It
+// keeps two generations to stay bounded without tracking ages.
+var seenEvents = struct {
+	sync.Mutex
+	current, previous map[string]struct{}
+}{current: make(map[string]struct{})}
+
+// markEventSeen returns false if the event was already seen
+func markEventSeen(id string) bool {
+	seenEvents.Lock()
+	defer seenEvents.Unlock()
+
+	if _, ok := seenEvents.current[id]; ok {
+		return false
+	}
+	if _, ok := seenEvents.previous[id]; ok {
+		return false
+	}
+
+	if len(seenEvents.current) >= seenEventsCapacity {
+		seenEvents.previous = seenEvents.current
+		seenEvents.current = make(map[string]struct{}, seenEventsCapacity)
+	}
+	seenEvents.current[id] = struct{}{}
+	return true
+}
+
+// handleAdminRelays reports upstream relay health (GET) or reloads the relay
+// config (POST). It requires the ADMIN_API_KEY as a bearer token.
+func handleAdminRelays(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := reloadRelays(ctx); err != nil {
+			http.Error(w, "Error reloading relays: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(GetRelayStats()); err != nil {
+		http.Error(w, "Error encoding response: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func isAdminRequest(r *http.Request) bool {
+	adminKey := os.Getenv("ADMIN_API_KEY")
+	if adminKey == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(adminKey)) == 1
+}
@@ -19,43 +19,76 @@ type NostrRepository struct {
 }
 
 type FeedNote struct {
-	Event nostr.Event
-	Score float64
+	Event     nostr.Event
+	Score     float64
+	Breakdown ScoreBreakdown // What each part of the ranking added to Score
 }
 
 type EventWithMeta struct {
 	Event                nostr.Event
-	GlobalCommentsCount  int
-	GlobalReactionsCount int
+	GlobalCommentsCount  int // Unique commenters in the thread, other than the author
+	GlobalDirectReplies  int // Unique commenters replying to the note itself
+	GlobalReactionsCount int // Likes, "+" or empty reactions
+	GlobalEmojiCount     int // Emoji and other custom reactions
+	GlobalDislikesCount  int // "-" reactions
 	GlobalZapsCount      int
+	GlobalZapSats        int64
+	GlobalRepostsCount   int // Kind 6 and 16 reposts
+	GlobalQuotesCount    int // Notes quoting this one
 	InteractionCount     int
 	CreatedAt            time.Time
 }
 
 type AuthorInteraction struct {
-	AuthorID         string
-	InteractionCount int
+	AuthorID          string
+	InteractionCount  int
+	ZapSats           int64 // Sats the user zapped to this author
+	Followed          bool  // The user follows this author directly
+	FollowedByFollows int   // Number of the user's follows who follow this author
 }
 
 var viralNoteCache struct {
-	notes     []FeedNote
+	notes     []EventWithMeta // Raw engagement counts, scored per user
 	Timestamp time.Time
 }
 var viralNoteCacheMutex sync.Mutex
 
 const PubkeyLength = 64
 
+// viralPoolSize is how many of the most engaged notes are kept in the shared
+// viral pool. It is larger than a single feed so users with a low viral
+// threshold still have enough candidates after filtering.
+const viralPoolSize = 500
+
 // UserSettings represents the algorithm settings for a specific user
 type UserSettings struct {
-	PubKey             string  `json:"pubkey"`
-	AuthorInteractions float64 `json:"authorInteractions"`
-	GlobalComments     float64 `json:"globalComments"`
-	GlobalReactions    float64 `json:"globalReactions"`
-	GlobalZaps         float64 `json:"globalZaps"`
-	Recency            float64 `json:"recency"`
-	DecayRate          float64 `json:"decayRate"`
-	ViralThreshold     float64 `json:"viralThreshold"`
-	ViralDampening     float64 `json:"viralDampening"`
+	PubKey               string  `json:"pubkey"`
+	AuthorInteractions   float64 `json:"authorInteractions"`
+	GlobalComments       float64 `json:"globalComments"`
+	GlobalDirectReplies  float64 `json:"globalDirectReplies"`
+	GlobalReactions      float64 `json:"globalReactions"`
+	GlobalEmojiReactions float64 `json:"globalEmojiReactions"`
+	GlobalDislikes       float64 `json:"globalDislikes"` // Penalty per dislike
+	GlobalZaps           float64 `json:"globalZaps"`
+	GlobalReposts        float64 `json:"globalReposts"` // Per repost or quote
+	Recency              float64 `json:"recency"`
+	DecayRate            float64 `json:"decayRate"`
+	ViralThreshold       float64 `json:"viralThreshold"`
+	ViralDampening       float64 `json:"viralDampening"`
+	Follows              float64 `json:"follows"`
+	FollowsOfFollows     float64 `json:"followsOfFollows"`
+	ReportPenalty        float64 `json:"reportPenalty"`
+	GlobalZapAmount      float64 `json:"globalZapAmount"`
+	ZapCurve             string  `json:"zapCurve"` // How zapped sats are scaled: "log", "sqrt" or "linear"
+	// Replies chooses which replies can be feed candidates: "off", "follows"
+	// for replies between people the user follows, or "all"
+	Replies string `json:"replies"`
+	// KindQuotas caps the share (0-1) of a mixed feed each kind can take.
+	// Kinds without a quota share the feed evenly.
+	KindQuotas map[int]float64 `json:"kindQuotas,omitempty"`
+	// RequireAuthForReads keeps the user's settings, top authors, metrics
+	// and onboarding status private to NIP-98 requests they sign
+	RequireAuthForReads bool `json:"requireAuthForReads"`
 }
 
 // UserMetrics represents the user's activity metrics on Nostr
@@ -71,118 +104,55 @@ func NewNostrRepository(db *sql.DB) *NostrRepository {
 }
 
 func (r *NostrRepository) SaveNostrEvent(event *nostr.Event) error {
+	if event.Kind != 5 {
+		deleted, err := r.isDeleted(event)
+		if err != nil {
+			return err
+		}
+		if deleted {
+			return fmt.Errorf("event %s was deleted by its author", event.ID)
+		}
+	}
+
 	switch event.Kind {
-	case 1: // note
-		return r.saveNoteOrComment(event)
-	case 7: // Reaction
-		return r.saveReaction(event)
-	case 9735: // Zap
-		return r.saveZap(event)
 	case 3: // Follow
 		return r.upsertFollowList(event)
-	case 2: // Comment
-		return r.saveNoteOrComment(event)
-	default:
-		return r.saveNoteWithKind(event)
-	}
-}
-
-func (r *NostrRepository) saveNoteWithKind(event *nostr.Event) error {
-	query := `
-        INSERT INTO notes (id, author_id, kind, content, raw_json, created_at)
-        VALUES ($1, $2, $3, $4, $5, to_timestamp($6))
-        ON CONFLICT (id) DO NOTHING;
-    `
-	_, err := r.db.ExecContext(context.Background(), query,
-		event.ID, event.PubKey, event.Kind, event.Content, event.String(), event.CreatedAt)
-	return err
-}
-
-func (r *NostrRepository) saveNoteOrComment(event *nostr.Event) error {
-	rootID := getRootNoteID(event)
-	if rootID == "" {
-		return r.saveNoteWithKind(event)
-	}
-	return r.saveComment(event, rootID)
-}
-
-func (r *NostrRepository) saveComment(event *nostr.Event, rootID string) error {
-	query := `
-        INSERT INTO comments (id, note_id, commenter_id, created_at)
-        VALUES ($1, $2, $3, to_timestamp($4))
-        ON CONFLICT (id) DO NOTHING;
-    `
-	_, err := r.db.ExecContext(context.Background(), query,
-		event.ID, rootID, event.PubKey, event.CreatedAt)
-	return err
-}
-
-func getRootNoteID(event *nostr.Event) string {
-	var rootID string
-	for _, tag := range event.Tags {
-		if len(tag) > 0 && tag[0] == "e" {
-			if len(tag) >= 3 && (tag[2] == "root" || tag[2] == "") {
-				rootID = tag[1]
-				break
-			}
+	case 10000: // Mute list
+		return r.saveMuteList(event)
+	case 1984: // Report
+		return r.saveReport(event)
+	case 5: // Deletion
+		return r.saveDeletion(event)
+	case 0: // Profile metadata, for the LNURL zap provider
+		return r.saveZapProvider(event)
+	case 10002: // NIP-65 relay list, for the outbox relays
+		return r.saveRelayList(event)
+	default: // Notes, comments, reactions and zaps
+		var batch eventBatch
+		if err := r.addToBatch(event, &batch); err != nil {
+			return err
 		}
+		return r.insertBatch(context.Background(), &batch)
 	}
-	return rootID
-}
-
-func (r *NostrRepository) saveReaction(event *nostr.Event) error {
-	noteID, err := getTaggedNoteID(event)
-	if err != nil {
-		return err
-	}
-	query := `
-        INSERT INTO reactions (id, note_id, reactor_id, created_at)
-        VALUES ($1, $2, $3, to_timestamp($4))
-        ON CONFLICT (id) DO NOTHING;
-    `
-	_, err = r.db.ExecContext(context.Background(), query,
-		event.ID, noteID, event.PubKey, event.CreatedAt)
-	return err
 }
 
-func (r *NostrRepository) saveZap(event *nostr.Event) error {
-	noteID, err := getTaggedNoteID(event)
-	if err != nil {
-		return err
-	}
-	amount, err := getZapAmount(event)
-	if err != nil {
-		return err
-	}
-	zapperID, err := getZapperID(event)
-	if err != nil {
-		return err
-	}
-	query := `
-        INSERT INTO zaps (id, note_id, zapper_id, amount, created_at)
-        VALUES ($1, $2, $3, $4, to_timestamp($5))
-        ON CONFLICT (id) DO NOTHING;
-    `
-	_, err = r.db.ExecContext(context.Background(), query,
-		event.ID, noteID, zapperID, amount, event.CreatedAt)
-	return err
+// getRootNoteID returns the note that started the thread the event replies
+// to, or "" if the event isn't a reply
+func getRootNoteID(event *nostr.Event) string {
+	ref, _ := parseThread(event)
+	return ref.RootID
 }
 
-func getZapperID(event *nostr.Event) (string, error) {
-	for _, tag := range event.Tags {
-		if len(tag) > 0 && tag[0] == "description" {
-			// Parse the description JSON
-			var descriptionData struct {
-				PubKey string `json:"pubkey"`
-			}
-			err := json.Unmarshal([]byte(tag[1]), &descriptionData)
-			if err != nil {
-				return "", fmt.Errorf("error parsing description tag: %v", err)
-			}
-			return descriptionData.PubKey, nil
-		}
+// reactionType classifies a NIP-25 reaction by its content
+func reactionType(content string) string {
+	switch strings.TrimSpace(content) {
+	case "", "+":
+		return "like"
+	case "-":
+		return "dislike"
+	default:
+		return "emoji"
 	}
-	return "", fmt.Errorf("no zapper pubkey found in description tag")
 }
 
 func getTaggedNoteID(event *nostr.Event) (string, error) {
@@ -194,36 +164,19 @@ func getTaggedNoteID(event *nostr.Event) (string, error) {
 	return "", fmt.Errorf("no note ID found in event tags")
 }
 
-func getZapAmount(event *nostr.Event) (int64, error) {
-	for _, tag := range event.Tags {
-		if len(tag) > 0 && tag[0] == "bolt11" {
-			return decodeBolt11Invoice(tag[1])
-		}
-	}
-	return 0, fmt.Errorf("no zap amount found in event tags")
-}
-
-func decodeBolt11Invoice(bolt11 string) (int64, error) {
-	millisat, err := hrpToMillisat(bolt11)
-	if err != nil {
-		return 0, err
-	}
-	satsInt64 := millisat.Int64() / 1000
-	return satsInt64, nil
-}
-
 func (r *NostrRepository) fetchTopInteractedAuthors(userID string) ([]AuthorInteraction, error) {
 	start := time.Now()
 	query := `
 		WITH zap_counts AS (
-			SELECT p.author_id, COUNT(z.id) AS interaction_count
+			SELECT p.author_id, COUNT(z.id) AS interaction_count, COALESCE(SUM(z.amount), 0) AS zap_sats
 			FROM notes p
 			JOIN zaps z ON p.id = z.note_id
 			WHERE z.zapper_id = $1
 			GROUP BY p.author_id
 		),
 		reaction_counts AS (
-			SELECT p.author_id, COUNT(r.id) AS interaction_count
+			-- Dislikes count against the author
+			SELECT p.author_id, SUM(CASE WHEN r.reaction_type = 'dislike' THEN -1 ELSE 1 END) AS interaction_count
 			FROM notes p
 			JOIN reactions r ON p.id = r.note_id
 			WHERE r.reactor_id = $1
@@ -235,14 +188,24 @@ func (r *NostrRepository) fetchTopInteractedAuthors(userID string) ([]AuthorInte
 			JOIN comments c ON p.id = c.note_id
 			WHERE c.commenter_id = $1
 			GROUP BY p.author_id
+		),
+		repost_counts AS (
+			-- Reposts and quotes
+			SELECT p.author_id, COUNT(rp.id) AS interaction_count
+			FROM notes p
+			JOIN reposts rp ON p.id = rp.note_id
+			WHERE rp.reposter_id = $1
+			GROUP BY p.author_id
 		)
-		SELECT author_id, SUM(interaction_count) AS interaction_count
+		SELECT author_id, SUM(interaction_count) AS interaction_count, SUM(zap_sats) AS zap_sats
 		FROM (
-			SELECT author_id, interaction_count FROM zap_counts
+			SELECT author_id, interaction_count, zap_sats FROM zap_counts
+			UNION ALL
+			SELECT author_id, interaction_count, 0 FROM reaction_counts
 			UNION ALL
-			SELECT author_id, interaction_count FROM reaction_counts
+			SELECT author_id, interaction_count, 0 FROM comment_counts
 			UNION ALL
-			SELECT author_id, interaction_count FROM comment_counts
+			SELECT author_id, interaction_count, 0 FROM repost_counts
 		) AS interactions
 		GROUP BY author_id
 		ORDER BY interaction_count DESC;
@@ -257,47 +220,120 @@ func (r *NostrRepository) fetchTopInteractedAuthors(userID string) ([]AuthorInte
 	for rows.Next() {
 		var authorID string
 		var interactionCount int
-		if err := rows.Scan(&authorID, &interactionCount); err != nil {
+		var zapSats int64
+		if err := rows.Scan(&authorID, &interactionCount, &zapSats); err != nil {
 			return nil, err
 		}
 		authors = append(authors, AuthorInteraction{
 			AuthorID:         authorID,
 			InteractionCount: interactionCount,
+			ZapSats:          zapSats,
 		})
 	}
 	log.Printf("Fetched top interacted authors in %v", time.Since(start))
 	return authors, nil
 }
 
-func (r *NostrRepository) GetViralnotes(ctx context.Context, limit int) ([]FeedNote, error) {
+// maxNotesByID caps how many notes one filter can look up by ID
+const maxNotesByID = 500
+
+// GetNotesByIDs returns the stored notes with the given IDs
+func (r *NostrRepository) GetNotesByIDs(ctx context.Context, ids []string) ([]*nostr.Event, error) {
+	if len(ids) > maxNotesByID {
+		ids = ids[:maxNotesByID]
+	}
+
+	rows, err := r.db.QueryContext(ctx, `SELECT raw_json FROM notes WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching notes: %v", err)
+	}
+	defer rows.Close()
+
+	var notes []*nostr.Event
+	for rows.Next() {
+		var rawJSON string
+		if err := rows.Scan(&rawJSON); err != nil {
+			return nil, err
+		}
+		var event nostr.Event
+		if err := json.Unmarshal([]byte(rawJSON), &event); err != nil {
+			log.Printf("Failed to unmarshal raw JSON: %v", err)
+			continue
+		}
+		notes = append(notes, &event)
+	}
+	return notes, rows.Err()
+}
+
+// GetViralnotes returns the most engaged notes of the last 3 days with their raw
+// engagement counts. Thresholding, dampening and scoring happen per user.
+func (r *NostrRepository) GetViralnotes(ctx context.Context, limit int) ([]EventWithMeta, error) {
 	// Calculate the date 3 days ago
 	threeDaysAgo := time.Now().AddDate(0, 0, -3)
 
 	query := `
-    SELECT p.raw_json, COUNT(c.id) AS comment_count, COUNT(r.id) AS reaction_count, COUNT(z.id) AS zap_count
+    SELECT p.raw_json,
+        COALESCE(comment_counts.comment_count, 0) AS comment_count,
+        COALESCE(comment_counts.direct_reply_count, 0) AS direct_reply_count,
+        COALESCE(reaction_counts.like_count, 0) AS like_count,
+        COALESCE(reaction_counts.emoji_count, 0) AS emoji_count,
+        COALESCE(reaction_counts.dislike_count, 0) AS dislike_count,
+        COALESCE(zap_counts.zap_count, 0) AS zap_count,
+        COALESCE(zap_counts.zap_sats, 0) AS zap_sats,
+        COALESCE(repost_counts.repost_count, 0) AS repost_count,
+        COALESCE(repost_counts.quote_count, 0) AS quote_count
     FROM notes p
-    LEFT JOIN comments c ON p.id = c.note_id
-    LEFT JOIN reactions r ON p.id = r.note_id
-    LEFT JOIN zaps z ON p.id = z.note_id
-    WHERE p.created_at >= $3  -- Filter to only include notes from the last 3 days
-    GROUP BY p.id
-    HAVING COUNT(c.id) + COUNT(r.id) + COUNT(z.id) >= $1
-    ORDER BY COUNT(c.id) + COUNT(r.id) + COUNT(z.id) DESC
-    LIMIT $2;
+    LEFT JOIN (
+        -- Count people rather than replies, so a long back and forth between
+        -- two accounts doesn't look like a big discussion
+        SELECT c.note_id,
+            COUNT(DISTINCT c.commenter_id) AS comment_count,
+            COUNT(DISTINCT c.commenter_id) FILTER (WHERE c.depth = 1) AS direct_reply_count
+        FROM comments c
+        JOIN notes n ON n.id = c.note_id
+        WHERE c.commenter_id <> n.author_id
+        GROUP BY c.note_id
+    ) comment_counts ON p.id = comment_counts.note_id
+    LEFT JOIN (
+        SELECT note_id,
+            COUNT(*) FILTER (WHERE reaction_type = 'like') AS like_count,
+            COUNT(*) FILTER (WHERE reaction_type = 'emoji') AS emoji_count,
+            COUNT(*) FILTER (WHERE reaction_type = 'dislike') AS dislike_count,
+            SUM(CASE WHEN reaction_type = 'dislike' THEN -1 ELSE 1 END) AS reaction_count
+        FROM reactions GROUP BY note_id
+    ) reaction_counts ON p.id = reaction_counts.note_id
+    LEFT JOIN (
+        SELECT note_id, COUNT(*) AS zap_count, SUM(amount) AS zap_sats FROM zaps GROUP BY note_id
+    ) zap_counts ON p.id = zap_counts.note_id
+    LEFT JOIN (
+        SELECT note_id,
+            COUNT(*) FILTER (WHERE NOT quote) AS repost_count,
+            COUNT(*) FILTER (WHERE quote) AS quote_count
+        FROM reposts GROUP BY note_id
+    ) repost_counts ON p.id = repost_counts.note_id
+    WHERE p.created_at >= $2  -- Filter to only include notes from the last 3 days
+    AND p.root_id IS NULL     -- Replies only reach feeds through their authors
+    AND COALESCE(comment_counts.comment_count, 0) + COALESCE(reaction_counts.reaction_count, 0) + COALESCE(zap_counts.zap_count, 0)
+        + COALESCE(repost_counts.repost_count, 0) + COALESCE(repost_counts.quote_count, 0) > 0
+    ORDER BY COALESCE(comment_counts.comment_count, 0) + COALESCE(reaction_counts.reaction_count, 0) + COALESCE(zap_counts.zap_count, 0)
+        + COALESCE(repost_counts.repost_count, 0) + COALESCE(repost_counts.quote_count, 0) DESC
+    LIMIT $1;
 `
 
-	rows, err := r.db.QueryContext(context.Background(), query, viralThreshold, limit, threeDaysAgo)
+	rows, err := r.db.QueryContext(ctx, query, limit, threeDaysAgo)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	viralnotes := make([]FeedNote, 0, limit)
+	viralnotes := make([]EventWithMeta, 0, limit)
 	for rows.Next() {
 		var rawJSON string
-		var commentCount, reactionCount, zapCount int
+		var commentCount, directReplyCount, likeCount, emojiCount, dislikeCount, zapCount, repostCount, quoteCount int
+		var zapSats int64
 
-		if err := rows.Scan(&rawJSON, &commentCount, &reactionCount, &zapCount); err != nil {
+		if err := rows.Scan(&rawJSON, &commentCount, &directReplyCount, &likeCount, &emojiCount, &dislikeCount, &zapCount, &zapSats,
+			&repostCount, &quoteCount); err != nil {
 			return nil, err
 		}
 
@@ -307,36 +343,39 @@ func (r *NostrRepository) GetViralnotes(ctx context.Context, limit int) ([]FeedN
 			continue
 		}
 
-		recencyFactor := calculateRecencyFactorWithDecay(event.CreatedAt.Time(), decayRate)
-		score := (float64(commentCount)*weightCommentsGlobal +
-			float64(reactionCount)*weightReactionsGlobal +
-			float64(zapCount)*weightZapsGlobal +
-			recencyFactor*weightRecency) * viralNoteDampening
-
-		viralnotes = append(viralnotes, FeedNote{
-			Event: event,
-			Score: score,
+		viralnotes = append(viralnotes, EventWithMeta{
+			Event:                event,
+			GlobalCommentsCount:  commentCount,
+			GlobalDirectReplies:  directReplyCount,
+			GlobalReactionsCount: likeCount,
+			GlobalEmojiCount:     emojiCount,
+			GlobalDislikesCount:  dislikeCount,
+			GlobalZapsCount:      zapCount,
+			GlobalZapSats:        zapSats,
+			GlobalRepostsCount:   repostCount,
+			GlobalQuotesCount:    quoteCount,
+			CreatedAt:            event.CreatedAt.Time(),
 		})
 	}
 
 	return viralnotes, nil
 }
 
-func (r *NostrRepository) fetchNotesFromAuthors(authorInteractions []AuthorInteraction, kind int) ([]EventWithMeta, error) {
+// fetchNotesFromAuthors returns the authors' recent notes. Replies are included
+// per the replies setting; with "follows", both the reply's author and the
+// author it answers must be in follows.
+func (r *NostrRepository) fetchNotesFromAuthors(authors []AuthorInteraction, kinds []int, replies string, follows []string) ([]EventWithMeta, error) {
 	// Extract author IDs and interaction counts
 	start := time.Now()
-	authorIDs := make([]string, 0, len(authorInteractions))
-	interactionCounts := make([]int, 0, len(authorInteractions))
-
-	for _, authorInteraction := range authorInteractions {
-		// Only include authors with an interaction count >= 5
-		if authorInteraction.InteractionCount >= 5 {
-			authorIDs = append(authorIDs, authorInteraction.AuthorID)
-			interactionCounts = append(interactionCounts, authorInteraction.InteractionCount)
-		}
+	authorIDs := make([]string, 0, len(authors))
+	interactionCounts := make([]int, 0, len(authors))
+
+	for _, author := range authors {
+		authorIDs = append(authorIDs, author.AuthorID)
+		interactionCounts = append(interactionCounts, author.InteractionCount)
 	}
 
-	// If no authors meet the interaction count threshold, return early
+	// If there are no candidate authors, return early
 	if len(authorIDs) == 0 {
 		return nil, nil
 	}
@@ -350,37 +389,59 @@ func (r *NostrRepository) fetchNotesFromAuthors(authorInteractions []AuthorInter
 		)
 		SELECT p.raw_json,
 			COALESCE(comment_counts.comment_count, 0) AS comment_count,
-			COALESCE(reaction_counts.reaction_count, 0) AS reaction_count,
+			COALESCE(comment_counts.direct_reply_count, 0) AS direct_reply_count,
+			COALESCE(reaction_counts.like_count, 0) AS like_count,
+			COALESCE(reaction_counts.emoji_count, 0) AS emoji_count,
+			COALESCE(reaction_counts.dislike_count, 0) AS dislike_count,
 			COALESCE(zap_counts.zap_count, 0) AS zap_count,
+			COALESCE(zap_counts.zap_sats, 0) AS zap_sats,
+			COALESCE(repost_counts.repost_count, 0) AS repost_count,
+			COALESCE(repost_counts.quote_count, 0) AS quote_count,
 			ai.interaction_count
 		FROM notes p
 		JOIN author_interactions ai ON p.author_id = ai.author_id
 		LEFT JOIN (
-			SELECT note_id, COUNT(*) AS comment_count
-			FROM comments
-			WHERE created_at >= $4
-			GROUP BY note_id
+			SELECT c.note_id,
+				COUNT(DISTINCT c.commenter_id) AS comment_count,
+				COUNT(DISTINCT c.commenter_id) FILTER (WHERE c.depth = 1) AS direct_reply_count
+			FROM comments c
+			JOIN notes n ON n.id = c.note_id
+			WHERE c.created_at >= $4 AND c.commenter_id <> n.author_id
+			GROUP BY c.note_id
 		) comment_counts ON p.id = comment_counts.note_id
 		LEFT JOIN (
-			SELECT note_id, COUNT(*) AS reaction_count
+			SELECT note_id,
+				COUNT(*) FILTER (WHERE reaction_type = 'like') AS like_count,
+				COUNT(*) FILTER (WHERE reaction_type = 'emoji') AS emoji_count,
+				COUNT(*) FILTER (WHERE reaction_type = 'dislike') AS dislike_count
 			FROM reactions
 			WHERE created_at >= $4
 			GROUP BY note_id
 		) reaction_counts ON p.id = reaction_counts.note_id
 		LEFT JOIN (
-			SELECT note_id, COUNT(*) AS zap_count
+			SELECT note_id, COUNT(*) AS zap_count, SUM(amount) AS zap_sats
 			FROM zaps
 			WHERE created_at >= $4
 			GROUP BY note_id
 		) zap_counts ON p.id = zap_counts.note_id
+		LEFT JOIN (
+			SELECT note_id,
+				COUNT(*) FILTER (WHERE NOT quote) AS repost_count,
+				COUNT(*) FILTER (WHERE quote) AS quote_count
+			FROM reposts
+			WHERE created_at >= $4
+			GROUP BY note_id
+		) repost_counts ON p.id = repost_counts.note_id
 		WHERE p.author_id = ANY($1)
-		AND ai.interaction_count >= 5  -- Filter by interaction count
 		AND p.created_at >= $4         -- Filter notes created within the last week
-		AND p.kind = $5                -- Filter by kind
+		AND p.kind = ANY($5)           -- Filter by requested kinds
+		AND (p.root_id IS NULL OR $6 = 'all'
+			OR ($6 = 'follows' AND p.author_id = ANY($7) AND p.parent_author_id = ANY($7)))
 		ORDER BY p.created_at DESC;
 	`
 
-	rows, err := r.db.QueryContext(context.Background(), query, pq.Array(authorIDs), pq.Array(authorIDs), pq.Array(interactionCounts), oneWeekAgo, kind)
+	rows, err := r.db.QueryContext(context.Background(), query, pq.Array(authorIDs), pq.Array(authorIDs), pq.Array(interactionCounts), oneWeekAgo, pq.Array(kinds),
+		replies, pq.Array(follows))
 	if err != nil {
 		return nil, err
 	}
@@ -389,9 +450,11 @@ func (r *NostrRepository) fetchNotesFromAuthors(authorInteractions []AuthorInter
 	notes := make([]EventWithMeta, 0, len(interactionCounts))
 	for rows.Next() {
 		var rawJSON string
-		var commentCount, reactionCount, zapCount, interactionCount int
+		var commentCount, directReplyCount, likeCount, emojiCount, dislikeCount, zapCount, repostCount, quoteCount, interactionCount int
+		var zapSats int64
 
-		if err := rows.Scan(&rawJSON, &commentCount, &reactionCount, &zapCount, &interactionCount); err != nil {
+		if err := rows.Scan(&rawJSON, &commentCount, &directReplyCount, &likeCount, &emojiCount, &dislikeCount, &zapCount, &zapSats,
+			&repostCount, &quoteCount, &interactionCount); err != nil {
 			return nil, err
 		}
 
@@ -404,8 +467,14 @@ func (r *NostrRepository) fetchNotesFromAuthors(authorInteractions []AuthorInter
 		notes = append(notes, EventWithMeta{
 			Event:                event,
 			GlobalCommentsCount:  commentCount,
-			GlobalReactionsCount: reactionCount,
+			GlobalDirectReplies:  directReplyCount,
+			GlobalReactionsCount: likeCount,
+			GlobalEmojiCount:     emojiCount,
+			GlobalDislikesCount:  dislikeCount,
 			GlobalZapsCount:      zapCount,
+			GlobalZapSats:        zapSats,
+			GlobalRepostsCount:   repostCount,
+			GlobalQuotesCount:    quoteCount,
 			InteractionCount:     interactionCount,
 			CreatedAt:            event.CreatedAt.Time(),
 		})
@@ -432,7 +501,7 @@ func refreshViralNotesPeriodically(ctx context.Context) {
 
 func refreshViralNotes(ctx context.Context) {
 	// Fetch new viral notes
-	viralnotes, err := repository.GetViralnotes(ctx, 100) // Set a reasonable limit for viral notes
+	viralnotes, err := repository.GetViralnotes(ctx, viralPoolSize)
 	if err != nil {
 		log.Printf("Failed to refresh viral notes: %v", err)
 		return
@@ -477,6 +546,24 @@ func (r *NostrRepository) upsertFollowList(event *nostr.Event) error {
 	}
 	defer tx.Rollback()
 
+	// Only replace the stored follows with a newer list. The row lock also
+	// keeps concurrent lists of the same author from interleaving.
+	listQuery := `
+		INSERT INTO follow_lists (pubkey, event_id, created_at)
+		VALUES ($1, $2, to_timestamp($3))
+		ON CONFLICT (pubkey) DO UPDATE SET
+			event_id = EXCLUDED.event_id,
+			created_at = EXCLUDED.created_at
+		WHERE follow_lists.created_at < EXCLUDED.created_at
+	`
+	result, err := tx.ExecContext(ctx, listQuery, event.PubKey, event.ID, event.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save follow list: %v", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return nil
+	}
+
 	deleteQuery := `DELETE FROM follows WHERE pubkey = $1`
 	_, err = tx.ExecContext(ctx, deleteQuery, event.PubKey)
 	if err != nil {
@@ -505,6 +592,70 @@ func (r *NostrRepository) upsertFollowList(event *nostr.Event) error {
 	return nil
 }
 
+// fetchFollows returns the pubkeys the user follows according to their latest kind 3 event
+func (r *NostrRepository) fetchFollows(userID string) ([]string, error) {
+	query := `
+		SELECT DISTINCT follow_id
+		FROM follows
+		WHERE pubkey = $1 AND follow_id <> $1;
+	`
+	rows, err := r.db.QueryContext(context.Background(), query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var follows []string
+	for rows.Next() {
+		var followID string
+		if err := rows.Scan(&followID); err != nil {
+			return nil, err
+		}
+		follows = append(follows, followID)
+	}
+	return follows, rows.Err()
+}
+
+// fetchFollowsOfFollows returns authors the user does not follow yet, ranked by
+// how many of the user's follows follow them
+func (r *NostrRepository) fetchFollowsOfFollows(userID string, minOverlap, limit int) ([]AuthorInteraction, error) {
+	start := time.Now()
+	query := `
+		WITH direct_follows AS (
+			SELECT DISTINCT follow_id FROM follows WHERE pubkey = $1
+		)
+		SELECT f.follow_id, COUNT(DISTINCT f.pubkey) AS followed_by
+		FROM follows f
+		JOIN direct_follows df ON f.pubkey = df.follow_id
+		WHERE f.follow_id <> $1
+		AND f.follow_id NOT IN (SELECT follow_id FROM direct_follows)
+		GROUP BY f.follow_id
+		HAVING COUNT(DISTINCT f.pubkey) >= $2
+		ORDER BY followed_by DESC
+		LIMIT $3;
+	`
+	rows, err := r.db.QueryContext(context.Background(), query, userID, minOverlap, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	authors := make([]AuthorInteraction, 0, limit)
+	for rows.Next() {
+		var authorID string
+		var followedBy int
+		if err := rows.Scan(&authorID, &followedBy); err != nil {
+			return nil, err
+		}
+		authors = append(authors, AuthorInteraction{
+			AuthorID:          authorID,
+			FollowedByFollows: followedBy,
+		})
+	}
+	log.Printf("Fetched follows of follows in %v", time.Since(start))
+	return authors, rows.Err()
+}
+
 func (r *NostrRepository) PurgeCommentsOlderThan(months int) error {
 	cutoffDate := time.Now().AddDate(0, -months, 0)
 	query := `
@@ -556,6 +707,17 @@ func (r *NostrRepository) PurgeNotesOlderThan(months int) error {
 		return fmt.Errorf("failed to purge zaps for old notes: %v", err)
 	}
 
+	// Delete reposts and quotes of old notes
+	repostsQuery := `
+        DELETE FROM reposts
+        WHERE note_id IN (
+            SELECT id FROM notes WHERE created_at < $1
+        );
+    `
+	if _, err := r.db.ExecContext(context.Background(), repostsQuery, cutoffDate); err != nil {
+		return fmt.Errorf("failed to purge reposts for old notes: %v", err)
+	}
+
 	// Delete the old notes
 	notesQuery := `
         DELETE FROM notes
@@ -600,6 +762,36 @@ func (r *NostrRepository) PurgeZapsOlderThan(months int) error {
 	return nil
 }
 
+func (r *NostrRepository) PurgeRepostsOlderThan(months int) error {
+	cutoffDate := time.Now().AddDate(0, -months, 0)
+	query := `
+        DELETE FROM reposts
+        WHERE created_at < $1;
+    `
+	result, err := r.db.ExecContext(context.Background(), query, cutoffDate)
+	if err != nil {
+		return fmt.Errorf("failed to purge reposts: %v", err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	fmt.Printf("Purged %d reposts older than %d months\n", rowsAffected, months)
+	return nil
+}
+
+func (r *NostrRepository) PurgeReportsOlderThan(months int) error {
+	cutoffDate := time.Now().AddDate(0, -months, 0)
+	query := `
+        DELETE FROM reports
+        WHERE created_at < $1;
+    `
+	result, err := r.db.ExecContext(context.Background(), query, cutoffDate)
+	if err != nil {
+		return fmt.Errorf("failed to purge reports: %v", err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	fmt.Printf("Purged %d reports older than %d months\n", rowsAffected, months)
+	return nil
+}
+
 // SaveUserSettings saves or updates a user's algorithm settings
 func (r *NostrRepository) SaveUserSettings(settings UserSettings) error {
 	// Convert settings to JSON
@@ -638,25 +830,16 @@ func (r *NostrRepository) GetUserSettings(pubkey string) (UserSettings, error) {
 
 	if err == sql.ErrNoRows {
 		// Return default settings from environment variables
-		return UserSettings{
-			PubKey:             pubkey,
-			AuthorInteractions: weightInteractionsWithAuthor,
-			GlobalComments:     weightCommentsGlobal,
-			GlobalReactions:    weightReactionsGlobal,
-			GlobalZaps:         weightZapsGlobal,
-			Recency:            weightRecency,
-			DecayRate:          decayRate,
-			ViralThreshold:     viralThreshold,
-			ViralDampening:     viralNoteDampening,
-		}, nil
+		return defaultUserSettings(pubkey), nil
 	}
 
 	if err != nil {
 		return UserSettings{}, err
 	}
 
-	// Unmarshal the JSON settings
-	var settings UserSettings
+	// Unmarshal the JSON settings on top of the defaults so that settings saved
+	// before a field existed pick up the global value for it
+	settings := defaultUserSettings(pubkey)
 	if err := json.Unmarshal(settingsJSON, &settings); err != nil {
 		return UserSettings{}, fmt.Errorf("error unmarshaling settings: %v", err)
 	}
@@ -664,6 +847,31 @@ func (r *NostrRepository) GetUserSettings(pubkey string) (UserSettings, error) {
 	return settings, nil
 }
 
+// defaultUserSettings returns the global algorithm weights configured through the environment
+func defaultUserSettings(pubkey string) UserSettings {
+	return UserSettings{
+		PubKey:               pubkey,
+		AuthorInteractions:   weightInteractionsWithAuthor,
+		GlobalComments:       weightCommentsGlobal,
+		GlobalDirectReplies:  weightDirectRepliesGlobal,
+		GlobalReactions:      weightReactionsGlobal,
+		GlobalEmojiReactions: weightEmojiReactionsGlobal,
+		GlobalDislikes:       weightDislikesGlobal,
+		GlobalZaps:           weightZapsGlobal,
+		GlobalReposts:        weightRepostsGlobal,
+		Recency:              weightRecency,
+		DecayRate:            decayRate,
+		ViralThreshold:       viralThreshold,
+		ViralDampening:       viralNoteDampening,
+		Follows:              weightFollows,
+		FollowsOfFollows:     weightFollowsOfFollows,
+		ReportPenalty:        weightReportPenalty,
+		GlobalZapAmount:      weightZapAmountGlobal,
+		ZapCurve:             zapAmountCurve,
+		Replies:              feedReplies,
+	}
+}
+
 // GetUserMetrics retrieves activity metrics for a specific user
 func (r *NostrRepository) GetUserMetrics(pubkey string) (UserMetrics, error) {
 	// Get network size (unique authors interacted with)
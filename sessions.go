@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionTTL        = 12 * time.Hour
+	sessionCookieName = "algo_session"
+)
+
+// Session is a signed-in dashboard user
+type Session struct {
+	Token     string
+	PubKey    string
+	ExpiresAt time.Time
+}
+
+// sessionToken returns the session token from the cookie set by /auth, or
+// from an "Authorization: Bearer" header for clients that don't keep cookies
+func sessionToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func hashSessionToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// setSessionCookie stores the session in an HTTP-only cookie. SameSite=Strict
+// keeps other sites from making requests with it.
+func setSessionCookie(w http.ResponseWriter, session Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    session.Token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(publicBaseURL(), "https://"),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// handleLogout revokes the caller's session
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if token := sessionToken(r); token != "" {
+		if err := repository.RevokeSession(token); err != nil {
+			http.Error(w, "Error revoking session: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	clearSessionCookie(w)
+	sendAuthResponse(w, AuthResponse{Success: true})
+}
+
+// CreateSession starts a session for the pubkey and returns its token, which
+// is only stored hashed
+func (r *NostrRepository) CreateSession(pubkey string) (Session, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Session{}, fmt.Errorf("error generating session token: %v", err)
+	}
+	session := Session{
+		Token:     hex.EncodeToString(secret),
+		PubKey:    pubkey,
+		ExpiresAt: time.Now().Add(sessionTTL).UTC(),
+	}
+
+	query := `INSERT INTO sessions (token_hash, pubkey, expires_at) VALUES ($1, $2, $3)`
+	if _, err := r.db.ExecContext(context.Background(), query, hashSessionToken(session.Token), pubkey, session.ExpiresAt); err != nil {
+		return Session{}, fmt.Errorf("error creating session: %v", err)
+	}
+	return session, nil
+}
+
+// GetSessionPubkey returns the pubkey of a live session, or "" if the token is
+// unknown, expired or revoked
+func (r *NostrRepository) GetSessionPubkey(token string) (string, error) {
+	query := `
+		SELECT pubkey FROM sessions
+		WHERE token_hash = $1 AND revoked_at IS NULL AND expires_at > NOW() AT TIME ZONE 'UTC'
+	`
+	var pubkey string
+	err := r.db.QueryRowContext(context.Background(), query, hashSessionToken(token)).Scan(&pubkey)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error fetching session: %v", err)
+	}
+	return pubkey, nil
+}
+
+func (r *NostrRepository) RevokeSession(token string) error {
+	query := `UPDATE sessions SET revoked_at = NOW() WHERE token_hash = $1 AND revoked_at IS NULL`
+	if _, err := r.db.ExecContext(context.Background(), query, hashSessionToken(token)); err != nil {
+		return fmt.Errorf("error revoking session: %v", err)
+	}
+	return nil
+}
+
+func (r *NostrRepository) PurgeExpiredSessions() error {
+	query := `DELETE FROM sessions WHERE expires_at < NOW() AT TIME ZONE 'UTC' OR revoked_at IS NOT NULL`
+	result, err := r.db.ExecContext(context.Background(), query)
+	if err != nil {
+		return fmt.Errorf("failed to purge sessions: %v", err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	fmt.Printf("Purged %d expired sessions\n", rowsAffected)
+	return nil
+}
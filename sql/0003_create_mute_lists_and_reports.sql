@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS mute_lists (
+    pubkey TEXT PRIMARY KEY,
+    muted_pubkeys TEXT[] NOT NULL DEFAULT '{}',
+    muted_hashtags TEXT[] NOT NULL DEFAULT '{}',
+    muted_words TEXT[] NOT NULL DEFAULT '{}',
+    muted_threads TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS reports (
+    id TEXT PRIMARY KEY,
+    reporter_id TEXT,
+    reported_pubkey TEXT,
+    note_id TEXT,
+    report_type TEXT,
+    created_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_reports_note_id ON reports(note_id);
+CREATE INDEX IF NOT EXISTS idx_reports_reporter_id ON reports(reporter_id);
+CREATE INDEX IF NOT EXISTS idx_reports_created_at ON reports(created_at);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS deletions (
+    event_id TEXT,
+    deleter_id TEXT,
+    deletion_id TEXT,
+    created_at TIMESTAMP,
+    PRIMARY KEY (event_id, deleter_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_deletions_created_at ON deletions(created_at);
+
+-- Zap receipts are published by the recipient's lightning provider, so a
+-- deletion of the receipt has to come from that pubkey rather than the zapper
+ALTER TABLE zaps ADD COLUMN IF NOT EXISTS receipt_pubkey TEXT;
@@ -0,0 +1,9 @@
+-- The LNURL pay endpoint of each profile (from lud16/lud06 in kind 0) and the
+-- nostrPubkey it signs zap receipts with, once resolved
+CREATE TABLE IF NOT EXISTS zap_providers (
+    pubkey TEXT PRIMARY KEY,
+    lnurl TEXT,
+    nostr_pubkey TEXT,
+    resolved_at TIMESTAMP,
+    created_at TIMESTAMP
+);
@@ -0,0 +1,6 @@
+-- NIP-25 reactions: "+" or empty is a like, "-" a dislike, anything else an
+-- emoji. Reactions stored before this migration are counted as likes.
+ALTER TABLE reactions ADD COLUMN IF NOT EXISTS content TEXT;
+ALTER TABLE reactions ADD COLUMN IF NOT EXISTS reaction_type TEXT NOT NULL DEFAULT 'like';
+
+CREATE INDEX IF NOT EXISTS idx_reactions_note_id_type ON reactions(note_id, reaction_type);
@@ -0,0 +1,7 @@
+-- High-water mark of the events received from each upstream relay, used to
+-- backfill the gap after a disconnect or restart
+CREATE TABLE IF NOT EXISTS relay_checkpoints (
+    relay_url TEXT PRIMARY KEY,
+    last_event_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,9 @@
+-- Progress of historical imports per relay, so an interrupted import resumes
+-- where it stopped. job_key identifies the import's since, kinds and authors.
+CREATE TABLE IF NOT EXISTS import_checkpoints (
+    job_key TEXT,
+    relay_url TEXT,
+    completed_until TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (job_key, relay_url)
+);
@@ -0,0 +1,14 @@
+-- Background import of a new user's own history (reactions, zaps, replies,
+-- follows) so their feed is personalised from the first visit
+CREATE TABLE IF NOT EXISTS onboarding_jobs (
+    pubkey TEXT PRIMARY KEY,
+    status TEXT NOT NULL DEFAULT 'queued', -- queued, running, done or failed
+    phase TEXT,
+    events_imported INTEGER NOT NULL DEFAULT 0,
+    error TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    started_at TIMESTAMP,
+    finished_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_onboarding_jobs_status ON onboarding_jobs(status);
@@ -0,0 +1,10 @@
+-- Latest NIP-65 relay list per author, used to read authors from their own
+-- write relays (the outbox model)
+CREATE TABLE IF NOT EXISTS relay_lists (
+    pubkey TEXT PRIMARY KEY,
+    event_id TEXT NOT NULL,
+    read_relays TEXT[] NOT NULL DEFAULT '{}',
+    write_relays TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
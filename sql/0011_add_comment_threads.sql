@@ -0,0 +1,11 @@
+-- Thread structure of replies: note_id stays the root of the thread, parent_id
+-- is the event directly replied to and depth counts from the root (1 for
+-- direct replies)
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS parent_id TEXT;
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS depth INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS kind INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS mentions TEXT[] NOT NULL DEFAULT '{}';
+
+UPDATE comments SET parent_id = note_id WHERE parent_id IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_comments_parent_id ON comments(parent_id);
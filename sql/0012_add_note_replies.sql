@@ -0,0 +1,8 @@
+-- Replies are stored as notes too so they can be ranked in feeds. root_id and
+-- parent_id are NULL for top-level notes; parent_author_id is the author of the
+-- event replied to, when known.
+ALTER TABLE notes ADD COLUMN IF NOT EXISTS root_id TEXT;
+ALTER TABLE notes ADD COLUMN IF NOT EXISTS parent_id TEXT;
+ALTER TABLE notes ADD COLUMN IF NOT EXISTS parent_author_id TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_notes_root_id ON notes(root_id);
@@ -0,0 +1,15 @@
+-- Reposts (kind 6 and 16) and quotes (q tags, NIP-18). A quote can reference
+-- several notes, so the key includes the note.
+CREATE TABLE IF NOT EXISTS reposts (
+    id TEXT NOT NULL,
+    note_id TEXT NOT NULL REFERENCES notes(id),
+    reposter_id TEXT NOT NULL,
+    kind INTEGER NOT NULL,
+    quote BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (id, note_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_reposts_note_id ON reposts(note_id);
+CREATE INDEX IF NOT EXISTS idx_reposts_reposter_id ON reposts(reposter_id);
+CREATE INDEX IF NOT EXISTS idx_reposts_created_at ON reposts(created_at);
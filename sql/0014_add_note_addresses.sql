@@ -0,0 +1,48 @@
+-- Addressable events (kinds 30000-39999, such as NIP-23 articles) are
+-- identified by "kind:pubkey:d-tag". Only the latest revision of an address is
+-- stored, so the address is unique.
+ALTER TABLE notes ADD COLUMN IF NOT EXISTS address TEXT;
+
+UPDATE notes n
+SET address = n.kind || ':' || n.author_id || ':' || COALESCE(
+    (SELECT t->>1 FROM jsonb_array_elements(n.raw_json->'tags') t WHERE t->>0 = 'd' LIMIT 1), '')
+WHERE n.kind BETWEEN 30000 AND 39999 AND n.address IS NULL;
+
+-- note_id_for returns the note stored for an address, so engagement naming
+-- an address joins its latest revision, or else the given note ID
+CREATE OR REPLACE FUNCTION note_id_for(note_address TEXT, fallback_id TEXT) RETURNS TEXT AS $$
+    SELECT COALESCE((SELECT id FROM notes WHERE address = NULLIF(note_address, '')), fallback_id)
+$$ LANGUAGE sql STABLE;
+
+-- move_note_revision moves engagement on a replaced revision to the new one,
+-- then drops the old revision
+CREATE OR REPLACE FUNCTION move_note_revision(old_id TEXT, new_id TEXT) RETURNS void AS $$
+    UPDATE reactions SET note_id = new_id WHERE note_id = old_id;
+    UPDATE zaps SET note_id = new_id WHERE note_id = old_id;
+    UPDATE comments SET note_id = new_id WHERE note_id = old_id;
+    UPDATE comments SET parent_id = new_id WHERE parent_id = old_id;
+    UPDATE notes SET root_id = new_id WHERE root_id = old_id;
+    UPDATE notes SET parent_id = new_id WHERE parent_id = old_id;
+    DELETE FROM reposts r
+    WHERE r.note_id = old_id AND EXISTS (SELECT 1 FROM reposts o WHERE o.id = r.id AND o.note_id = new_id);
+    UPDATE reposts SET note_id = new_id WHERE note_id = old_id;
+    DELETE FROM notes WHERE id = old_id;
+$$ LANGUAGE sql;
+
+-- Move engagement on older revisions to the latest one, then drop them
+CREATE TEMP TABLE superseded_notes AS
+SELECT n.id AS old_id, latest.id AS new_id
+FROM notes n
+CROSS JOIN LATERAL (
+    SELECT l.id FROM notes l
+    WHERE l.address = n.address
+    ORDER BY l.created_at DESC, l.id ASC
+    LIMIT 1
+) latest
+WHERE n.address IS NOT NULL AND latest.id <> n.id;
+
+SELECT move_note_revision(old_id, new_id) FROM superseded_notes;
+
+DROP TABLE superseded_notes;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_notes_address ON notes(address) WHERE address IS NOT NULL;
@@ -0,0 +1,12 @@
+-- Dashboard sessions issued by /auth. Only a hash of the token is stored, so
+-- the table can't be used to impersonate anyone.
+CREATE TABLE IF NOT EXISTS sessions (
+    token_hash TEXT PRIMARY KEY,
+    pubkey TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_pubkey ON sessions(pubkey);
+CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at);
@@ -0,0 +1,13 @@
+-- Named feeds a user can pick from their client with a #f filter or by
+-- connecting to /feed/<name>. Each has its own weights and default kinds.
+CREATE TABLE IF NOT EXISTS feed_profiles (
+    pubkey TEXT NOT NULL,
+    name TEXT NOT NULL,
+    kinds INTEGER[] NOT NULL DEFAULT '{}',
+    settings JSONB NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (pubkey, name)
+);
+
+CREATE INDEX IF NOT EXISTS idx_feed_profiles_name ON feed_profiles(name);
@@ -0,0 +1,7 @@
+-- The follow list (kind 3) each author's follows rows come from, so an older
+-- list fetched from another relay can't replace a newer one
+CREATE TABLE IF NOT EXISTS follow_lists (
+    pubkey TEXT PRIMARY KEY,
+    event_id TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,3 @@
+-- The count is of events fetched and handed to the database, some of which
+-- are skipped there (duplicates, engagement on unknown notes)
+ALTER TABLE onboarding_jobs RENAME COLUMN events_imported TO events_fetched;
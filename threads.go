@@ -0,0 +1,123 @@
+package main
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// threadRef is where a reply sits in its thread
+type threadRef struct {
+	RootID       string   // The note that started the thread
+	RootAddress  string   // Address of the root when it is an addressable event
+	ParentID     string   // The event directly replied to, the root for top-level replies
+	ParentAuthor string   // Author of the parent when the tags name it
+	Mentions     []string // Pubkeys tagged in the reply
+}
+
+// parseThread finds the root and parent of a reply. Kind 1111 comments use
+// NIP-22 tags. Other kinds use NIP-10 "root" and "reply" markers, or the
+// deprecated positional form where the first e tag is the root and the last
+// is the parent. It returns false for events that aren't replies to a note.
+func parseThread(event *nostr.Event) (threadRef, bool) {
+	var ref threadRef
+	if event.Kind == 1111 {
+		ref.RootID, ref.RootAddress, ref.ParentID, ref.ParentAuthor = nip22Thread(event)
+	} else {
+		ref.RootID, ref.ParentID, ref.ParentAuthor = nip10Thread(event)
+	}
+	if ref.RootID == "" && ref.RootAddress == "" {
+		return threadRef{}, false
+	}
+	// A comment naming only the root's address leaves the parent to be
+	// resolved once the address is looked up
+	if ref.ParentID == "" {
+		ref.ParentID = ref.RootID
+	}
+
+	seen := make(map[string]bool)
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || (tag[0] != "p" && tag[0] != "P") || len(tag[1]) != PubkeyLength {
+			continue
+		}
+		if !seen[tag[1]] && tag[1] != event.PubKey {
+			seen[tag[1]] = true
+			ref.Mentions = append(ref.Mentions, tag[1])
+		}
+	}
+	return ref, true
+}
+
+// nip22Thread reads the uppercase E or A (root) and lowercase e (parent) tags
+// of a NIP-22 comment, and the lowercase p tag naming the parent's author.
+// Comments on external content have no root note and are ignored.
+func nip22Thread(event *nostr.Event) (rootID, rootAddress, parentID, parentAuthor string) {
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		if tag[0] == "A" {
+			if _, ok := parseAddress(tag[1]); ok {
+				rootAddress = tag[1]
+			}
+			continue
+		}
+		if !nostr.IsValid32ByteHex(tag[1]) {
+			continue
+		}
+		switch tag[0] {
+		case "E":
+			rootID = tag[1]
+		case "e":
+			parentID = tag[1]
+		case "p":
+			parentAuthor = tag[1]
+		}
+	}
+	return rootID, rootAddress, parentID, parentAuthor
+}
+
+// nip10Thread also reads the parent's author from the optional pubkey after
+// the marker of the parent's e tag
+func nip10Thread(event *nostr.Event) (rootID, parentID, parentAuthor string) {
+	var positional []string
+	var rootAuthor, replyAuthor string
+	marked := false
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "e" || !nostr.IsValid32ByteHex(tag[1]) {
+			continue
+		}
+		marker, author := "", ""
+		if len(tag) >= 4 {
+			marker = tag[3]
+		}
+		if len(tag) >= 5 && len(tag[4]) == PubkeyLength {
+			author = tag[4]
+		}
+		switch marker {
+		case "root":
+			marked = true
+			rootID, rootAuthor = tag[1], author
+		case "reply":
+			marked = true
+			parentID, replyAuthor = tag[1], author
+		case "mention":
+			marked = true
+		default:
+			positional = append(positional, tag[1])
+		}
+	}
+
+	if marked {
+		// Some clients only mark the parent of a top-level reply
+		if rootID == "" {
+			rootID, rootAuthor = parentID, replyAuthor
+		}
+		if parentID == "" || parentID == rootID {
+			return rootID, parentID, rootAuthor
+		}
+		return rootID, parentID, replyAuthor
+	}
+	if len(positional) == 0 {
+		return "", "", ""
+	}
+	return positional[0], positional[len(positional)-1], ""
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestParseThread(t *testing.T) {
+	root := strings.Repeat("1", 64)
+	parent := strings.Repeat("2", 64)
+	other := strings.Repeat("3", 64)
+	rootAuthor := strings.Repeat("a", 64)
+	parentAuthor := strings.Repeat("b", 64)
+	self := strings.Repeat("c", 64)
+	address := "30023:" + rootAuthor + ":article"
+
+	tests := []struct {
+		name    string
+		kind    int
+		tags    nostr.Tags
+		want    threadRef
+		isReply bool
+	}{
+		{
+			name:    "marked root and reply",
+			kind:    1,
+			tags:    nostr.Tags{{"e", root, "", "root", rootAuthor}, {"e", parent, "", "reply", parentAuthor}},
+			want:    threadRef{RootID: root, ParentID: parent, ParentAuthor: parentAuthor},
+			isReply: true,
+		},
+		{
+			name:    "marked root only",
+			kind:    1,
+			tags:    nostr.Tags{{"e", root, "", "root", rootAuthor}},
+			want:    threadRef{RootID: root, ParentID: root, ParentAuthor: rootAuthor},
+			isReply: true,
+		},
+		{
+			name:    "marked parent only",
+			kind:    1,
+			tags:    nostr.Tags{{"e", parent, "", "reply", parentAuthor}},
+			want:    threadRef{RootID: parent, ParentID: parent, ParentAuthor: parentAuthor},
+			isReply: true,
+		},
+		{
+			name:    "marked tags ignore unmarked ones",
+			kind:    1,
+			tags:    nostr.Tags{{"e", other}, {"e", root, "", "root"}, {"e", parent, "", "reply"}},
+			want:    threadRef{RootID: root, ParentID: parent},
+			isReply: true,
+		},
+		{
+			name:    "positional with a single e tag",
+			kind:    1,
+			tags:    nostr.Tags{{"e", root}},
+			want:    threadRef{RootID: root, ParentID: root},
+			isReply: true,
+		},
+		{
+			name:    "positional with root, mention and parent",
+			kind:    1,
+			tags:    nostr.Tags{{"e", root}, {"e", other}, {"e", parent}},
+			want:    threadRef{RootID: root, ParentID: parent},
+			isReply: true,
+		},
+		{
+			name: "only mentions",
+			kind: 1,
+			tags: nostr.Tags{{"e", other, "", "mention"}},
+		},
+		{
+			name: "invalid event IDs",
+			kind: 1,
+			tags: nostr.Tags{{"e", "not-an-id", "", "root"}},
+		},
+		{
+			name: "no e tags",
+			kind: 1,
+			tags: nostr.Tags{{"p", rootAuthor}},
+		},
+		{
+			name:    "mentions skip the author, duplicates and bad pubkeys",
+			kind:    1,
+			tags:    nostr.Tags{{"e", root}, {"p", rootAuthor}, {"p", self}, {"p", rootAuthor}, {"p", "short"}, {"P", parentAuthor}},
+			want:    threadRef{RootID: root, ParentID: root, Mentions: []string{rootAuthor, parentAuthor}},
+			isReply: true,
+		},
+		{
+			name:    "comment on a note",
+			kind:    1111,
+			tags:    nostr.Tags{{"E", root, "", rootAuthor}, {"e", parent}, {"p", parentAuthor}},
+			want:    threadRef{RootID: root, ParentID: parent, ParentAuthor: parentAuthor, Mentions: []string{parentAuthor}},
+			isReply: true,
+		},
+		{
+			name:    "top-level comment on an article by address",
+			kind:    1111,
+			tags:    nostr.Tags{{"A", address}, {"a", address}},
+			want:    threadRef{RootAddress: address},
+			isReply: true,
+		},
+		{
+			name: "comment on external content",
+			kind: 1111,
+			tags: nostr.Tags{{"I", "https://example.com"}, {"i", "https://example.com"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := &nostr.Event{PubKey: self, Kind: test.kind, Tags: test.tags}
+			got, isReply := parseThread(event)
+			if isReply != test.isReply {
+				t.Fatalf("isReply = %v, want %v", isReply, test.isReply)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseThread = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// zapProviderRefreshInterval is how long a resolved LNURL nostrPubkey is trusted
+const zapProviderRefreshInterval = 24 * time.Hour
+
+const zapProviderWorkers = 4
+
+var (
+	zapProviderQueue    = make(chan string, 1000) // Pubkeys whose LNURL needs resolving
+	zapProviderInFlight sync.Map
+)
+
+// lnurlClient fetches LNURL endpoints named in anyone's profile, so it only
+// talks https to public addresses, redirects included
+var lnurlClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: rejectNonPublicAddress}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many LNURL redirects")
+		}
+		if req.URL.Scheme != "https" {
+			return fmt.Errorf("LNURL redirect to non-https URL %s", req.URL)
+		}
+		return nil
+	},
+}
+
+// ZapReceipt is a validated NIP-57 zap receipt
+type ZapReceipt struct {
+	ZapperID    string
+	RecipientID string
+	Amount      int64 // Sats
+}
+
+// validateZapReceipt checks a zap receipt (kind 9735) as described in NIP-57:
+// the invoice commits to the embedded zap request, the request is signed by
+// the zapper and asks for the same recipient, note or address and amount, and
+// the receipt is signed by the recipient's LNURL provider when we know its
+// nostrPubkey.
+func (r *NostrRepository) validateZapReceipt(event *nostr.Event) (ZapReceipt, error) {
+	var bolt11, description, recipientID, noteID, address string
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "bolt11":
+			bolt11 = tag[1]
+		case "description":
+			description = tag[1]
+		case "p":
+			recipientID = tag[1]
+		case "e":
+			if noteID == "" {
+				noteID = tag[1]
+			}
+		case "a":
+			if address == "" {
+				address = tag[1]
+			}
+		}
+	}
+	if bolt11 == "" || description == "" || recipientID == "" {
+		return ZapReceipt{}, fmt.Errorf("zap receipt is missing bolt11, description or p tag")
+	}
+
+	invoice, err := decodeBolt11(bolt11)
+	if err != nil {
+		return ZapReceipt{}, fmt.Errorf("invalid bolt11 invoice: %v", err)
+	}
+	if invoice.MilliSats == nil {
+		return ZapReceipt{}, fmt.Errorf("zap invoice has no amount")
+	}
+
+	descriptionHash := sha256.Sum256([]byte(description))
+	if invoice.DescriptionHash != hex.EncodeToString(descriptionHash[:]) {
+		return ZapReceipt{}, fmt.Errorf("invoice description hash does not match the zap request")
+	}
+
+	var request nostr.Event
+	if err := json.Unmarshal([]byte(description), &request); err != nil {
+		return ZapReceipt{}, fmt.Errorf("error parsing zap request: %v", err)
+	}
+	if request.Kind != 9734 {
+		return ZapReceipt{}, fmt.Errorf("zap request has kind %d", request.Kind)
+	}
+	if ok, err := request.CheckSignature(); err != nil || !ok {
+		return ZapReceipt{}, fmt.Errorf("zap request signature is invalid")
+	}
+
+	var requestRecipient, requestNote, requestAddress, requestAmount string
+	for _, tag := range request.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "p":
+			requestRecipient = tag[1]
+		case "e":
+			requestNote = tag[1]
+		case "a":
+			requestAddress = tag[1]
+		case "amount":
+			requestAmount = tag[1]
+		}
+	}
+	if requestRecipient != recipientID {
+		return ZapReceipt{}, fmt.Errorf("zap request is for a different recipient")
+	}
+	if requestNote != "" && requestNote != noteID {
+		return ZapReceipt{}, fmt.Errorf("zap request is for a different note")
+	}
+	if requestAddress != "" && requestAddress != address {
+		return ZapReceipt{}, fmt.Errorf("zap request is for a different address")
+	}
+	if requestAmount != "" && requestAmount != invoice.MilliSats.String() {
+		return ZapReceipt{}, fmt.Errorf("invoice amount does not match the zap request")
+	}
+
+	providerPubkey, err := r.getZapProviderPubkey(recipientID)
+	if err != nil {
+		return ZapReceipt{}, err
+	}
+	if providerPubkey != "" && providerPubkey != event.PubKey {
+		return ZapReceipt{}, fmt.Errorf("zap receipt is not signed by the recipient's LNURL provider")
+	}
+
+	return ZapReceipt{
+		ZapperID:    request.PubKey,
+		RecipientID: recipientID,
+		Amount:      invoice.MilliSats.Int64() / 1000,
+	}, nil
+}
+
+// saveZapProvider records the LNURL pay endpoint from a profile (kind 0). The
+// endpoint is only resolved once the profile receives a zap.
+func (r *NostrRepository) saveZapProvider(event *nostr.Event) error {
+	var metadata struct {
+		Lud06 string `json:"lud06"`
+		Lud16 string `json:"lud16"`
+	}
+	if err := json.Unmarshal([]byte(event.Content), &metadata); err != nil {
+		return fmt.Errorf("error parsing profile metadata: %v", err)
+	}
+
+	lnurl := lnurlFromMetadata(metadata.Lud16, metadata.Lud06)
+
+	// Profiles are replaceable, only keep the newest one. A changed endpoint
+	// has to be resolved again.
+	query := `
+        INSERT INTO zap_providers (pubkey, lnurl, created_at)
+        VALUES ($1, NULLIF($2, ''), to_timestamp($3))
+        ON CONFLICT (pubkey) DO UPDATE SET
+            lnurl = EXCLUDED.lnurl,
+            nostr_pubkey = CASE WHEN zap_providers.lnurl IS NOT DISTINCT FROM EXCLUDED.lnurl
+                THEN zap_providers.nostr_pubkey ELSE NULL END,
+            resolved_at = CASE WHEN zap_providers.lnurl IS NOT DISTINCT FROM EXCLUDED.lnurl
+                THEN zap_providers.resolved_at ELSE NULL END,
+            created_at = EXCLUDED.created_at
+        WHERE zap_providers.created_at < EXCLUDED.created_at;
+    `
+	_, err := r.db.ExecContext(context.Background(), query, event.PubKey, lnurl, event.CreatedAt)
+	return err
+}
+
+// lnurlFromMetadata returns the LNURL pay endpoint for a lightning address
+// (lud16) or a bech32 encoded LNURL (lud06). Only https endpoints are used.
+func lnurlFromMetadata(lud16, lud06 string) string {
+	if name, domain, ok := strings.Cut(strings.TrimSpace(lud16), "@"); ok && name != "" && domain != "" {
+		endpoint := fmt.Sprintf("https://%s/.well-known/lnurlp/%s", domain, url.PathEscape(name))
+		if parsed, err := url.Parse(endpoint); err != nil || parsed.Host != domain || !isHTTPSURL(endpoint) {
+			return ""
+		}
+		return endpoint
+	}
+
+	if lud06 != "" {
+		hrp, data, err := decodeBech32(strings.TrimSpace(lud06))
+		if err != nil || hrp != "lnurl" {
+			return ""
+		}
+		endpoint, err := convertBits(data, 5, 8, false)
+		if err != nil || !isHTTPSURL(string(endpoint)) {
+			return ""
+		}
+		return string(endpoint)
+	}
+
+	return ""
+}
+
+// getZapProviderPubkey returns the nostrPubkey the recipient's LNURL provider
+// signs zap receipts with, or "" when it isn't known yet. Unknown or stale
+// providers are queued for resolution.
+func (r *NostrRepository) getZapProviderPubkey(recipientID string) (string, error) {
+	query := `
+		SELECT lnurl, COALESCE(nostr_pubkey, ''), resolved_at
+		FROM zap_providers
+		WHERE pubkey = $1
+	`
+
+	var lnurl sql.NullString
+	var nostrPubkey string
+	var resolvedAt sql.NullTime
+	err := r.db.QueryRowContext(context.Background(), query, recipientID).Scan(&lnurl, &nostrPubkey, &resolvedAt)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error fetching zap provider: %v", err)
+	}
+
+	if lnurl.Valid && (!resolvedAt.Valid || time.Since(resolvedAt.Time) > zapProviderRefreshInterval) {
+		queueZapProviderResolve(recipientID)
+	}
+	return nostrPubkey, nil
+}
+
+func queueZapProviderResolve(pubkey string) {
+	if _, loaded := zapProviderInFlight.LoadOrStore(pubkey, true); loaded {
+		return
+	}
+	select {
+	case zapProviderQueue <- pubkey:
+	default:
+		// Queue is full, the next zap will try again
+		zapProviderInFlight.Delete(pubkey)
+	}
+}
+
+// resolveZapProviders fetches queued LNURL pay endpoints in the background
+func (r *NostrRepository) resolveZapProviders(ctx context.Context) {
+	for i := 0; i < zapProviderWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case pubkey := <-zapProviderQueue:
+					if err := r.resolveZapProvider(ctx, pubkey); err != nil {
+						log.Printf("Error resolving zap provider for %s: %v", pubkey, err)
+					}
+					zapProviderInFlight.Delete(pubkey)
+				}
+			}
+		}()
+	}
+}
+
+func (r *NostrRepository) resolveZapProvider(ctx context.Context, pubkey string) error {
+	var lnurl string
+	err := r.db.QueryRowContext(ctx, `SELECT lnurl FROM zap_providers WHERE pubkey = $1 AND lnurl IS NOT NULL`, pubkey).Scan(&lnurl)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Failed lookups are remembered too so that a dead endpoint isn't hit on every zap
+	nostrPubkey, fetchErr := fetchLnurlNostrPubkey(ctx, lnurl)
+
+	query := `
+		UPDATE zap_providers
+		SET nostr_pubkey = NULLIF($3, ''), resolved_at = NOW()
+		WHERE pubkey = $1 AND lnurl = $2;
+	`
+	if _, err := r.db.ExecContext(ctx, query, pubkey, lnurl, nostrPubkey); err != nil {
+		return err
+	}
+	return fetchErr
+}
+
+func fetchLnurlNostrPubkey(ctx context.Context, lnurl string) (string, error) {
+	// Endpoints stored before only https was accepted
+	if !isHTTPSURL(lnurl) {
+		return "", fmt.Errorf("LNURL endpoint %s is not https", lnurl)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, lnurl, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := lnurlClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("LNURL endpoint returned %s", resp.Status)
+	}
+
+	var payParams struct {
+		AllowsNostr bool   `json:"allowsNostr"`
+		NostrPubkey string `json:"nostrPubkey"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&payParams); err != nil {
+		return "", fmt.Errorf("error parsing LNURL response: %v", err)
+	}
+
+	if !payParams.AllowsNostr || len(payParams.NostrPubkey) != PubkeyLength {
+		return "", nil
+	}
+	return payParams.NostrPubkey, nil
+}